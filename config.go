@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// fileConfig is the content of a -config file: the wrapped command and the
+// values of any flags, keyed by flag name
+type fileConfig struct {
+	command string
+	args    []string
+	flags   [][2]string // name and value, in file order
+}
+
+// loadConfig reads a -config file, either a JSON object such as
+//
+//	{"command": "java", "args": ["-jar", "app.jar"], "format": "json"}
+//
+// or key=value lines, with one "arg=" line per argument and # comments. Flags
+// that take several values are given as a JSON array or a repeated key.
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseJSONConfig(data)
+	}
+	return parseKeyValueConfig(data)
+}
+
+func parseJSONConfig(data []byte) (*fileConfig, error) {
+	// Numbers are kept as written, as float64 would print large ones such
+	// as 1048576 in exponent form that integer flags reject
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	// The object is read key by key, rather than into a map, so flags
+	// apply in file order
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('{') {
+		return nil, fmt.Errorf("config must be a JSON object")
+	}
+	config := &fileConfig{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string) // object keys are always strings
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		var values []string
+		switch v := value.(type) {
+		case []any:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		default:
+			values = []string{fmt.Sprint(v)}
+		}
+		switch key {
+		case "command":
+			if len(values) != 1 {
+				return nil, fmt.Errorf("command must be a string")
+			}
+			config.command = values[0]
+		case "args":
+			config.args = values
+		default:
+			for _, v := range values {
+				config.flags = append(config.flags, [2]string{key, v})
+			}
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func parseKeyValueConfig(data []byte) (*fileConfig, error) {
+	config := &fileConfig{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key=value", n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "command":
+			config.command = value
+		case "arg":
+			config.args = append(config.args, value)
+		default:
+			config.flags = append(config.flags, [2]string{key, value})
+		}
+	}
+	return config, scanner.Err()
+}
+
+// apply sets the flags named in the config that were not already set on the
+// command line or from the environment
+func (c *fileConfig) apply() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, kv := range c.flags {
+		name, value := kv[0], kv[1]
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseJSONConfig(t *testing.T) {
+	config, err := parseJSONConfig([]byte(`{"command": "cat", "args": ["-u", 1], "max-total": 1048576, "heartbeat": "30s", "tee": ["a.log", "b.log"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.command != "cat" || !slices.Equal(config.args, []string{"-u", "1"}) {
+		t.Errorf("command = %q %q", config.command, config.args)
+	}
+	flags := map[string][]string{}
+	for _, kv := range config.flags {
+		flags[kv[0]] = append(flags[kv[0]], kv[1])
+	}
+	want := map[string][]string{"max-total": {"1048576"}, "heartbeat": {"30s"}, "tee": {"a.log", "b.log"}}
+	for name, values := range want {
+		if !slices.Equal(flags[name], values) {
+			t.Errorf("%s = %q, want %q", name, flags[name], values)
+		}
+	}
+}
+
+func TestParseJSONConfigKeepsKeyOrder(t *testing.T) {
+	config, err := parseJSONConfig([]byte(`{"quiet": "out", "max-line": 10, "format": "json", "buffer-size": 64, "quiet": "err", "dirs": "in"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"quiet", "out"}, {"max-line", "10"}, {"format", "json"}, {"buffer-size", "64"}, {"quiet", "err"}, {"dirs", "in"}}
+	if !slices.Equal(config.flags, want) {
+		t.Errorf("flags = %q, want %q", config.flags, want)
+	}
+	for _, bad := range []string{`["cat"]`, `{"command": "cat"`, `{"command": }`} {
+		if _, err := parseJSONConfig([]byte(bad)); err == nil {
+			t.Errorf("parseJSONConfig(%s) succeeded", bad)
+		}
+	}
+}
@@ -1,3 +1,12 @@
 module github.com/colinzhu/stdio-logger-go
 
 go 1.24.0
+
+require (
+	github.com/creack/pty v1.1.24
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/term v0.32.0
+	golang.org/x/text v0.25.0
+)
+
+require golang.org/x/sys v0.33.0 // indirect
@@ -1,206 +1,894 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
+
+	"github.com/colinzhu/stdio-logger-go/stdiolog"
 )
 
-// forwardAndLogStdin reads from proxy's stdin, logs it, and writes to target's stdin
-func forwardAndLogStdin(proxyStdin io.Reader, targetStdin io.WriteCloser, logFile *os.File, wg *sync.WaitGroup) {
-	defer wg.Done()
-	buffer := make([]byte, 4096) // Use buffer for efficient reading
-
-	for {
-		n, err := proxyStdin.Read(buffer)
-		if n > 0 {
-			// Write to log file with ISO timestamp and "in:  " prefix
-			timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
-			logData := append([]byte(timestamp+" in:  "), buffer[:n]...)
-			_, logErr := logFile.Write(logData)
-			if logErr != nil {
-				log.Printf("Error writing to log file: %v", logErr)
-			}
-			logFile.Sync() // Flush immediately
-
-			// Write to target process stdin
-			_, writeErr := targetStdin.Write(buffer[:n])
-			if writeErr != nil {
-				log.Printf("Error writing to target stdin: %v", writeErr)
-				break
+// logTimestamp is the layout of the timestamp in log file names
+const logTimestamp = "2006-01-02_150405"
+
+// defaultLogDir returns the directory for the default log file: the
+// executable's if it is writable, else the temp directory, else the current
+// one, or "" if none of them is writable. With dryRun set, as for -check,
+// writability is judged from permissions without creating a probe file.
+func defaultLogDir(dryRun bool) string {
+	writable := writableDir
+	if dryRun {
+		writable = permitsWrite
+	}
+	var dirs []string
+	if exePath, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exePath))
+	}
+	dirs = append(dirs, os.TempDir(), ".")
+	for i, dir := range dirs {
+		if writable(dir) {
+			if i > 0 {
+				log.Printf("Executable directory not writable, logging to %s", dir)
 			}
+			return dir
 		}
+	}
+	return ""
+}
 
-		if err != nil {
-			// Log the error but continue processing
-			log.Printf("STDIN Forwarding Error: %v", err)
-			break
+// writableDir reports whether a file can be created in dir
+func writableDir(dir string) bool {
+	f, err := os.CreateTemp(dir, ".stdio-logger-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
+// logFileName returns the name of the default log file started at t,
+// stdio-<timestamp>.log, with any non-empty tags such as the -label
+// inserted as stdio-<tag>-...-<timestamp>.log
+func logFileName(t time.Time, tags ...string) string {
+	name := "stdio-"
+	for _, tag := range tags {
+		if tag != "" {
+			name += tag + "-"
 		}
 	}
+	return name + t.UTC().Format(logTimestamp) + ".log"
+}
+
+// manifestPath returns where the manifest of the rotated log at path is
+// kept: stdio-<timestamp>.manifest.json beside stdio-<timestamp>.log
+func manifestPath(path, compress string) string {
+	path = strings.TrimSuffix(path, stdiolog.CompressExt(compress))
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".manifest.json"
+}
+
+// validLabel matches the -label and file name -run-id values accepted,
+// which must be safe in a file name and free of spaces so log lines can be
+// split on them
+var validLabel = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
 
-	// Close target stdin when proxy stdin closes
-	if closeErr := targetStdin.Close(); closeErr != nil {
-		log.Printf("Error closing target stdin: %v", closeErr)
+// Build information, set with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%d)"
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// versionString describes the build for -version and the log header
+func versionString() string {
+	v := version
+	if commit != "" {
+		v += " commit " + commit
 	}
-	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
-	_, err := logFile.WriteString(timestamp + " --- STDIN stream closed to target ---\n")
-	if err != nil {
-		log.Printf("Error writing to log file: %v", err)
+	if date != "" {
+		v += " built " + date
 	}
-	logFile.Sync() // Ensure log is flushed
+	return v
 }
 
-// forwardAndLogStream reads from target's stdout/stderr, logs it, and writes to proxy's stdout
-func forwardAndLogStream(target io.Reader, proxy io.Writer, logFile *os.File, prefix string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	reader := bufio.NewReader(target)
-	for {
-		line, err := reader.ReadString('\n')
-		if len(line) > 0 {
-			timestamp := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
-			if strings.HasPrefix(line, prefix+" ") {
-				// already has prefix, write log directly (still add timestamp)
-				if !strings.HasSuffix(line, "\n") {
-					logFile.WriteString(timestamp + " " + line + "\n")
-				} else {
-					logFile.WriteString(timestamp + " " + line)
-				}
-			} else {
-				// no prefix, add prefix and write log
-				if !strings.HasSuffix(line, "\n") {
-					logFile.WriteString(timestamp + " " + prefix + line + "\n")
-				} else {
-					logFile.WriteString(timestamp + " " + prefix + line)
-				}
-			}
-			logFile.Sync()
-			// write to proxy
-			proxy.Write([]byte(line))
+// quietFlag is the value of -quiet: a bare -quiet silences both streams, while
+// -quiet=out or -quiet=err silences only the one named
+type quietFlag struct {
+	out, err bool
+}
+
+func (q *quietFlag) String() string {
+	var streams []string
+	if q.out {
+		streams = append(streams, "out")
+	}
+	if q.err {
+		streams = append(streams, "err")
+	}
+	return strings.Join(streams, ",")
+}
+
+func (q *quietFlag) Set(value string) error {
+	q.out, q.err = false, false
+	switch value {
+	case "true":
+		q.out, q.err = true, true
+		return nil
+	case "false":
+		return nil
+	}
+	for _, stream := range strings.Split(value, ",") {
+		switch stream {
+		case "out":
+			q.out = true
+		case "err":
+			q.err = true
+		default:
+			return fmt.Errorf("unknown stream %q: must be out or err", stream)
 		}
-		if err != nil {
-			break
+	}
+	return nil
+}
+
+func (q *quietFlag) IsBoolFlag() bool { return true }
+
+// listFlag collects the values of a flag that may be given more than once
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// envFlags maps flags to the environment variables that supply their value
+// when they are not given on the command line
+var envFlags = map[string]string{
+	"log-file":       "STDIO_LOGGER_LOGFILE",
+	"format":         "STDIO_LOGGER_FORMAT",
+	"flush-interval": "STDIO_LOGGER_FLUSH",
+}
+
+// fixedTimeEnv, when set to an RFC 3339 time, stamps the log and names the
+// default log file with that time instead of the clock, so runs can be
+// compared against golden logs. It is meant for tests, so it has no flag.
+const fixedTimeEnv = "STDIO_LOGGER_FIXED_TIME"
+
+// applyEnv sets each flag in envFlags that was not passed from its
+// environment variable, so flags take precedence
+func applyEnv() error {
+	passed := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+	for name, env := range envFlags {
+		value, ok := os.LookupEnv(env)
+		if !ok || passed[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", env, value, err)
 		}
 	}
+	return nil
 }
 
 func main() {
-	// Check if a command was provided
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <command> [args...]\n", os.Args[0])
-		os.Exit(1)
+	os.Exit(run())
+}
+
+// run sets up logging, runs the wrapped command and returns the exit code.
+// Keeping this separate from main lets deferred cleanup run before os.Exit.
+func run() int {
+	logEnvFlag := flag.Bool("log-env", false, "record the child's environment variables in the log header, with secrets redacted")
+	logEnvPrefixFlag := flag.String("log-env-prefix", "", "comma-separated prefixes limiting which variables -log-env records")
+	versionFlag := flag.Bool("version", false, "print the version, commit and build date and exit")
+	checkFlag := flag.Bool("check", false, "print the resolved command and log destination and exit without running anything")
+	pipelineFlag := flag.Bool("pipeline", false, "split the command at | arguments into stages piped into each other, logging each stage's output")
+	restartFlag := flag.Bool("restart", false, "relaunch the command when it exits with a non-zero status")
+	maxRestartsFlag := flag.Int("max-restarts", 0, "give up after this many restarts with -restart (0 means no limit)")
+	backoffFlag := flag.Duration("backoff", time.Second, "wait before the first restart with -restart, doubling for each further one up to a minute")
+	bufferSizeFlag := flag.Int("buffer-size", 4096, "size in bytes of the buffer the child's streams and stdin are read with")
+	annotateFlag := flag.Bool("annotate", false, "record the byte length and CRC32 of each logged chunk")
+	extraFDFlag := flag.Int("extra-fd", 0, "give the command a pipe as this file descriptor, e.g. 3, and log what it writes there as fd3: (Unix only)")
+	mergeStderrFlag := flag.Bool("merge-stderr", false, "forward the child's stderr to the proxy's stdout, like 2>&1; it is still logged as stderr")
+	heartbeatFlag := flag.Duration("heartbeat", 0, "log an idle marker whenever no data has crossed any stream for this long (0 disables)")
+	osyncFlag := flag.Bool("osync", false, "open log files with O_SYNC instead of syncing them after every entry")
+	logDirFlag := flag.String("log-dir", "", "write the default stdio-<timestamp>.log file to this directory instead of next to the executable")
+	ndjsonFlag := flag.Bool("ndjson", false, "log lines that are JSON messages pretty-printed, for newline-delimited JSON protocols")
+	metricsAddrFlag := flag.String("metrics-addr", "", "serve byte and restart counters as Prometheus metrics at /metrics on this address, e.g. :9090")
+	logModeFlag := flag.String("log-mode", "0644", "octal permissions of new log files, e.g. 0600; directories created for them get matching search bits")
+	turnsFlag := flag.Bool("turns", false, "log a --- turn: in->out --- marker whenever the direction of logged data changes")
+	seqFlag := flag.Bool("seq", false, "start each log line with a sequence number counted across all streams")
+	noMarkersFlag := flag.Bool("no-markers", false, "leave the --- ... --- markers, header included, out of the log so it holds only logged data")
+	noTimestampFlag := flag.Bool("no-timestamp", false, "leave timestamps out of the log so logs of different runs can be diffed")
+	triggerFlag := flag.String("trigger", "", "log nothing until data on any stream matches this regex, then log in full")
+	triggerContextFlag := flag.Int("trigger-context", 0, "with -trigger, keep the last this many KB from before the match and write them out when it occurs")
+	ringSizeFlag := flag.Int("ring-size", 0, "keep the last this many KB of the log in memory and write it out only if the command fails (0 writes everything)")
+	maxPendingFlag := flag.Int("max-pending", 10000, "with -jsonrpc, how many requests awaiting a response to remember for latency")
+	teardownTimeoutFlag := flag.Duration("teardown-timeout", 0, "once the command has exited, wait at most this long for its output to drain, then exit anyway (0 waits forever)")
+	execTimeoutFlag := flag.Duration("exec-timeout", 0, "stop the command with SIGTERM, then SIGKILL after -kill-grace, once it has run this long and exit 124 (0 disables)")
+	alignFlag := flag.Bool("align", false, "pad the in:, out: and err: labels to a common width so logged data lines up with custom -prefix-stdout/-prefix-stderr")
+	closeStdinFlag := flag.Bool("close-stdin-on-eof", true, "close the command's stdin when the proxy's stdin closes; -close-stdin-on-eof=false keeps it open until the command exits")
+	eofSignalFlag := flag.String("eof-signal", "", "close the command's stdin when the proxy receives this signal: hup, usr1 or usr2 (Unix only)")
+	summaryJSONFlag := flag.String("summary-json", "", "on exit write a JSON summary of the run to this file, or - for stderr")
+	stripANSIFlag := flag.Bool("strip-ansi", false, "remove ANSI escape sequences such as colors and cursor movement from the log")
+	shellPathFlag := flag.String("shell-path", "", "run this interpreter for -shell instead of sh, cmd.exe or powershell from PATH")
+	stdinListenFlag := flag.String("stdin-listen", "", "feed the command from one TCP connection accepted on this address, e.g. tcp://:9000, instead of the proxy's stdin")
+	stdinListenStdoutFlag := flag.Bool("stdin-listen-stdout", false, "with -stdin-listen, also send the command's stdout back over the connection")
+	stdinFileFlag := flag.String("stdin-file", "", "feed the command from this file instead of the proxy's stdin, closing its stdin at the end of the file")
+	stopOnStdoutCloseFlag := flag.Bool("stop-on-stdout-close", false, "shut the child down once the proxy's stdout is closed, e.g. when piped into head, instead of running on with its output only logged")
+	jsonrpcIndexFlag := flag.String("jsonrpc-index", "", "with -jsonrpc or -framing, also write a one-line summary of each message, without its payload, to this file")
+	stdoutFileFlag := flag.String("stdout-file", "", "also write the child's stdout verbatim, without timestamps or labels, to this file")
+	stderrFileFlag := flag.String("stderr-file", "", "also write the child's stderr verbatim, without timestamps or labels, to this file")
+	configFlag := flag.String("config", "", "read the command, args and flag values from this JSON or key=value file")
+	failFastFlag := flag.Bool("fail-fast", false, "exit with 127 before creating any log if the command, or with a shell its first word, is not found in PATH")
+	noShellFlag := flag.Bool("no-shell", false, "run the command directly instead of through sh -c or cmd.exe /C")
+	shellFlag := flag.String("shell", "", "wrap the command in sh, cmd, powershell or none (default cmd on Windows, sh elsewhere)")
+	ptyFlag := flag.Bool("pty", false, "run the command on a pseudo-terminal for interactive programs (Unix only)")
+	logDestFlag := flag.String("log-dest", "file", "where to write the log: file, stderr, stdout or syslog")
+	logFileFlag := flag.String("log-file", "", "write the log to this path instead of stdio-<timestamp>.log next to the executable (env STDIO_LOGGER_LOGFILE)")
+	appendFlag := flag.String("append", "", "append every run to this log file, separating runs with a new session marker")
+	gzipFlag := flag.Bool("gzip", false, "gzip-compress the log file, short for -compress gzip")
+	compressFlag := flag.String("compress", "none", "compress the log file with none, gzip or zstd (default name becomes stdio-<timestamp>.log.gz or .log.zst)")
+	formatFlag := flag.String("format", "text", "log format: text, json for one {ts, dir, data} object per line, or csv for timestamp,direction,bytes,data records (env STDIO_LOGGER_FORMAT)")
+	timeFormatFlag := flag.String("time-format", stdiolog.DefaultTimeFormat, "Go time layout for log timestamps")
+	localFlag := flag.Bool("local", false, "use local time for log timestamps instead of UTC")
+	base64Flag := flag.Bool("base64", false, "log each entry's data base64-encoded, so every entry is a single line")
+	binaryFlag := flag.Bool("binary", false, "log data as a hex dump and read stdout/stderr in blocks instead of lines")
+	var quiet quietFlag
+	flag.Var(&quiet, "quiet", "don't echo the child's output to the proxy's stdout/stderr; -quiet=out or -quiet=err silences one stream")
+	framingFlag := flag.String("framing", "", "parse stdin and stdout as frames and log each payload numbered: length32 for 4-byte big-endian length prefixes")
+	jsonrpcFlag := flag.Bool("jsonrpc", false, "log Content-Length framed JSON-RPC messages (LSP) pretty-printed and numbered")
+	encodingFlag := flag.String("encoding", "", "decode the child's output for the log from utf16le, utf16be, or auto (UTF-16 if it starts with a BOM)")
+	maxLineFlag := flag.Int("max-line", 0, "truncate logged lines longer than this many bytes (0 means no limit)")
+	colorFlag := flag.Bool("color", false, "show the child's stderr in red on a terminal (disabled when NO_COLOR is set)")
+	redactFlag := flag.String("redact", "", "comma-separated regexes whose matches are replaced with ***REDACTED*** in the log")
+	matchFlag := flag.String("match", "", "only log stdout/stderr lines matching this regex (combined with -nomatch: match AND NOT nomatch)")
+	noMatchFlag := flag.String("nomatch", "", "don't log stdout/stderr lines matching this regex (combined with -match: match AND NOT nomatch)")
+	noKillFlag := flag.Bool("no-kill", false, "never force-kill the child, only ask it to stop and wait for it; a hung child means a hung proxy")
+	killGroupFlag := flag.Bool("kill-group", false, "start the child in its own process group and signal the whole group, so a shell's descendants are not orphaned (Unix only)")
+	killGraceFlag := flag.Duration("kill-grace", 5*time.Second, "how long to wait after forwarding SIGINT/SIGTERM before killing the child")
+	dirsFlag := flag.String("dirs", "in,out,err", "comma-separated streams to log; the others are forwarded but not logged")
+	splitFlag := flag.Bool("split", false, "write stdin, stdout and stderr to separate .in.log, .out.log and .err.log files")
+	asyncLogFlag := flag.Int("async-log", 0, "write the log from a queue of this many entries, dropping the oldest when full, so a slow log never stalls the child (0 writes synchronously)")
+	flushIntervalFlag := flag.Duration("flush-interval", 0, "flush the log on this interval instead of after every write (0 flushes every write) (env STDIO_LOGGER_FLUSH)")
+	statsFlag := flag.Bool("stats", false, "append a summary of bytes forwarded per stream to the log on exit")
+	rotateIntervalFlag := flag.Duration("rotate-interval", 0, "start a new stdio-<timestamp>.log file on this interval, e.g. 24h (0 disables)")
+	maxTotalFlag := flag.Int64("max-total", 0, "stop logging, but keep forwarding, once this many bytes have been logged (0 for no limit)")
+	maxSizeFlag := flag.Int64("max-size", 0, "roll over to stdio-<timestamp>.N.log after this many megabytes (0 disables rotation)")
+	stdinRawFlag := flag.Bool("stdin-raw", false, "log stdin in the chunks it is read in instead of one entry per line")
+	runIDFlag := flag.String("run-id", "", "record this run id, e.g. of a CI job, in the log header")
+	runIDEnvFlag := flag.String("run-id-env", "", "take the run id from this environment variable, e.g. GITHUB_RUN_ID, when -run-id is not given")
+	runIDFileFlag := flag.Bool("run-id-file", false, "also put the run id in the default log file name, stdio-<run-id>-<timestamp>.log")
+	labelFlag := flag.String("label", "", "name this proxy in the default log file name, stdio-<label>-<timestamp>.log")
+	labelLinesFlag := flag.Bool("label-lines", false, "also record -label in every log line as label=<label>")
+	hostnameFlag := flag.String("hostname", "", "hostname recorded in the log header (default the machine's hostname)")
+	hostnameLinesFlag := flag.Bool("hostname-lines", false, "also record the hostname in every log line as host=<hostname>")
+	idsFlag := flag.Bool("ids", false, "record the child pid and a random session id in every log line")
+	writeTimeoutFlag := flag.Duration("write-timeout", 0, "give up forwarding stdin if a write to the child blocks this long (0 waits forever)")
+	prefixStdoutFlag := flag.String("prefix-stdout", "out: ", "label of stdout lines in the text log (may be empty)")
+	prefixStderrFlag := flag.String("prefix-stderr", "err: ", "label of stderr lines in the text log (may be empty)")
+	syslogFlag := flag.Bool("syslog", false, "also send every log entry to syslog")
+	syslogFacilityFlag := flag.String("syslog-facility", "user", "syslog facility for -syslog and -log-dest syslog")
+	syslogTagFlag := flag.String("syslog-tag", "stdio-logger", "syslog tag for -syslog and -log-dest syslog")
+	cwdFlag := flag.String("cwd", "", "run the command in this directory instead of the current one")
+	var envs listFlag
+	flag.Var(&envs, "env", "set KEY=VALUE in the command's environment, on top of the inherited one (repeatable)")
+	var tees listFlag
+	flag.Var(&tees, "tee", "also send the log to this file or tcp://host:port (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [args...]\n       %s -config <file> [flags]\n       %s replay [-speed N] <logfile> -- [flags] <command> [args...]\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	// "replay <logfile> -- ..." feeds the stdin recorded in a log to a new
+	// run configured by the arguments after "--"
+	var replay io.Reader
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		input, rest, err := replayInput(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		replay = input
+		os.Args = append([]string{os.Args[0]}, rest...)
+	}
+	// Parsing stops at the first non-flag argument, so flags meant for the
+	// wrapped command are left untouched
+	flag.Parse()
+	if *versionFlag {
+		fmt.Printf("stdio-logger %s\n", versionString())
+		return 0
+	}
+	if err := applyEnv(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
 
-	command := os.Args[1]
-	args := os.Args[2:]
+	now := time.Now
+	if fixed, ok := os.LookupEnv(fixedTimeEnv); ok {
+		t, err := time.Parse(time.RFC3339Nano, fixed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid %s %q: %v\n", fixedTimeEnv, fixed, err)
+			return 1
+		}
+		now = func() time.Time { return t }
+	}
 
-	// Create log file path in same directory as executable
-	exePath, err := os.Executable()
-	if err != nil {
-		log.Fatalf("Error getting executable path: %v", err)
+	var config *fileConfig
+	if *configFlag != "" {
+		var err error
+		if config, err = loadConfig(*configFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading -config %s: %v\n", *configFlag, err)
+			return 1
+		}
+		if err := config.apply(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in -config %s: %v\n", *configFlag, err)
+			return 1
+		}
 	}
-	timestamp := time.Now().UTC().Format("2006-01-02_150405")
-	logFileName := fmt.Sprintf("stdio-%s.log", timestamp)
-	logFilePath := filepath.Join(filepath.Dir(exePath), logFileName)
 
-	// Open log file in append mode
-	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Error creating log file: %v", err)
+	// The command comes from either the arguments or the config file
+	var command string
+	var args []string
+	switch {
+	case config != nil && config.command != "" && flag.NArg() > 0:
+		fmt.Fprintln(os.Stderr, "The command must be given either in -config or on the command line, not both")
+		return 1
+	case config != nil && config.command != "":
+		command, args = config.command, config.args
+	case flag.NArg() > 0:
+		command, args = flag.Arg(0), flag.Args()[1:]
+	default:
+		flag.Usage()
+		return 1
 	}
-	defer func() {
-		if err := logFile.Close(); err != nil {
-			log.Printf("Error closing log file: %v", err)
+
+	// With -pipeline a "|" argument separates one stage from the next
+	var pipeline [][]string
+	if *pipelineFlag {
+		stages := [][]string{{command}}
+		for _, arg := range args {
+			if arg == "|" {
+				stages = append(stages, nil)
+			} else {
+				stages[len(stages)-1] = append(stages[len(stages)-1], arg)
+			}
 		}
-	}()
+		for _, stage := range stages {
+			if len(stage) == 0 || stage[0] == "|" {
+				fmt.Fprintln(os.Stderr, "Empty -pipeline stage")
+				return 1
+			}
+		}
+		command, args, pipeline = stages[0][0], stages[0][1:], stages[1:]
+	}
 
-	// Detect OS and wrap command if needed
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		// Use cmd.exe /C for Windows built-in commands
-		allArgs := append([]string{"/C", command}, args...)
-		cmd = exec.Command("cmd.exe", allArgs...)
-	} else {
-		// Use sh -c for Unix-like systems
-		fullCmd := append([]string{command}, args...)
-		cmd = exec.Command("sh", "-c", strings.Join(fullCmd, " "))
+	// Compile redaction patterns up front so a bad pattern fails before the child starts
+	var redact []*regexp.Regexp
+	if *redactFlag != "" {
+		for _, pattern := range strings.Split(*redactFlag, ",") {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid -redact pattern %q: %v\n", pattern, err)
+				return 1
+			}
+			redact = append(redact, re)
+		}
 	}
 
-	// Set up pipes for stdin, stdout and stderr
-	pipeStdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Fatalf("Error creating stdin pipe: %v", err)
+	// Compile line filters once, failing before the child starts
+	compileFilter := func(name, pattern string) (*regexp.Regexp, bool) {
+		if pattern == "" {
+			return nil, true
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -%s pattern %q: %v\n", name, pattern, err)
+			return nil, false
+		}
+		return re, true
+	}
+	match, ok := compileFilter("match", *matchFlag)
+	if !ok {
+		return 1
+	}
+	noMatch, ok := compileFilter("nomatch", *noMatchFlag)
+	if !ok {
+		return 1
+	}
+	trigger, ok := compileFilter("trigger", *triggerFlag)
+	if !ok {
+		return 1
 	}
 
-	pipeStdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Error creating stdout pipe: %v", err)
+	logMode, err := strconv.ParseUint(*logModeFlag, 8, 32)
+	if err != nil || logMode > 0777 {
+		fmt.Fprintf(os.Stderr, "Invalid -log-mode %q: must be octal permissions such as 0600\n", *logModeFlag)
+		return 1
 	}
+	// Directories get search permission wherever the file is readable
+	logPerm := os.FileMode(logMode)
+	logDirPerm := logPerm | (logPerm&0444)>>2
 
-	pipeStderr, err := cmd.StderrPipe()
-	if err != nil {
-		log.Fatalf("Error creating stderr pipe: %v", err)
+	switch *compressFlag {
+	case "none", "gzip", "zstd":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -compress %q: must be none, gzip or zstd\n", *compressFlag)
+		return 1
+	}
+	if *gzipFlag {
+		if *compressFlag == "zstd" {
+			fmt.Fprintln(os.Stderr, "-gzip and -compress zstd can't be combined")
+			return 1
+		}
+		*compressFlag = "gzip"
+	}
+
+	if *labelFlag != "" && !validLabel.MatchString(*labelFlag) {
+		fmt.Fprintf(os.Stderr, "Invalid -label %q: use letters, digits, '.', '_' and '-' only\n", *labelFlag)
+		return 1
+	}
+	runID := *runIDFlag
+	if runID == "" && *runIDEnvFlag != "" {
+		runID = os.Getenv(*runIDEnvFlag)
+	}
+	var fileRunID string // in the default file name
+	if *runIDFileFlag && runID != "" {
+		if !validLabel.MatchString(runID) {
+			fmt.Fprintf(os.Stderr, "Invalid run id %q for -run-id-file: use letters, digits, '.', '_' and '-' only\n", runID)
+			return 1
+		}
+		fileRunID = runID
+	}
+
+	var label string // recorded in each line
+	if *labelLinesFlag {
+		if *labelFlag == "" {
+			fmt.Fprintln(os.Stderr, "-label-lines needs -label")
+			return 1
+		}
+		label = *labelFlag
 	}
 
-	// Start the target process
-	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting command: %v", err)
-		// Try to log the error too
-		_, logErr := logFile.WriteString(fmt.Sprintf("!!! Logger Error: %v\n", err))
-		if logErr != nil {
-			log.Printf("Error writing to log file: %v", logErr)
+	hostname := *hostnameFlag
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			log.Printf("Error getting hostname: %v", err)
 		}
-		logFile.Sync()
-		os.Exit(1) // Indicate logger failure
+	} else if !validLabel.MatchString(hostname) {
+		fmt.Fprintf(os.Stderr, "Invalid -hostname %q: use letters, digits, '.', '_' and '-' only\n", hostname)
+		return 1
 	}
 
-	var wg sync.WaitGroup
+	if *bufferSizeFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -buffer-size %d: must be positive\n", *bufferSizeFlag)
+		return 1
+	}
 
-	// Start forwarding stdin
-	wg.Add(1)
-	go forwardAndLogStdin(os.Stdin, pipeStdin, logFile, &wg)
+	proxy := &stdiolog.Proxy{
+		Command:           command,
+		Args:              args,
+		Pipeline:          pipeline,
+		NoShell:           *noShellFlag,
+		Shell:             *shellFlag,
+		ShellPath:         *shellPathFlag,
+		Dir:               *cwdFlag,
+		PTY:               *ptyFlag,
+		Format:            *formatFlag,
+		TimeFormat:        *timeFormatFlag,
+		Local:             *localFlag,
+		NoTimestamp:       *noTimestampFlag,
+		NoMarkers:         *noMarkersFlag,
+		Seq:               *seqFlag,
+		MaxTotal:          *maxTotalFlag,
+		Turns:             *turnsFlag,
+		FlushInterval:     *flushIntervalFlag,
+		AsyncLog:          *asyncLogFlag,
+		RingSize:          *ringSizeFlag * 1024,
+		Trigger:           trigger,
+		TriggerContext:    *triggerContextFlag * 1024,
+		Binary:            *binaryFlag,
+		Base64:            *base64Flag,
+		QuietStdout:       quiet.out,
+		QuietStderr:       quiet.err,
+		MergeStderr:       *mergeStderrFlag,
+		ExtraFD:           *extraFDFlag,
+		StopOnStdoutClose: *stopOnStdoutCloseFlag,
+		Color:             *colorFlag,
+		JSONRPC:           *jsonrpcFlag,
+		Framing:           *framingFlag,
+		NDJSON:            *ndjsonFlag,
+		MaxPending:        *maxPendingFlag,
+		MaxLine:           *maxLineFlag,
+		Encoding:          *encodingFlag,
+		Redact:            redact,
+		StripANSI:         *stripANSIFlag,
+		Annotate:          *annotateFlag,
+		Match:             match,
+		NoMatch:           noMatch,
+		ForwardSignals:    true,
+		KillGrace:         *killGraceFlag,
+		TeardownTimeout:   *teardownTimeoutFlag,
+		NoKill:            *noKillFlag,
+		KillGroup:         *killGroupFlag,
+		ExecTimeout:       *execTimeoutFlag,
+		Restart:           *restartFlag,
+		MaxRestarts:       *maxRestartsFlag,
+		RestartBackoff:    *backoffFlag,
+		WriteTimeout:      *writeTimeoutFlag,
+		Stats:             *statsFlag,
+		MetricsAddr:       *metricsAddrFlag,
+		Heartbeat:         *heartbeatFlag,
+		LineIDs:           *idsFlag,
+		Label:             label,
+		Hostname:          hostname,
+		HostnameLines:     *hostnameLinesFlag,
+		RunID:             runID,
+		Clock:             now,
+		LogEnv:            *logEnvFlag,
+		Prefixes:          &stdiolog.Prefixes{Stdout: *prefixStdoutFlag, Stderr: *prefixStderrFlag},
+		AlignPrefixes:     *alignFlag,
+		StdinRaw:          *stdinRawFlag,
+		KeepStdinOpen:     !*closeStdinFlag,
+		BufferSize:        *bufferSizeFlag,
+		Version:           versionString(),
+	}
+	if replay != nil {
+		proxy.Stdin = replay
+	}
+	if *stdinFileFlag != "" {
+		if replay != nil {
+			fmt.Fprintln(os.Stderr, "-stdin-file can't be used with replay")
+			return 1
+		}
+		stdinFile, err := os.Open(*stdinFileFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening -stdin-file: %v\n", err)
+			return 1
+		}
+		defer stdinFile.Close()
+		proxy.Stdin = stdinFile
+	}
+	if *stdinListenFlag != "" {
+		addr, ok := strings.CutPrefix(*stdinListenFlag, "tcp://")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Invalid -stdin-listen %q: must be tcp://host:port\n", *stdinListenFlag)
+			return 1
+		}
+		if replay != nil || *stdinFileFlag != "" {
+			fmt.Fprintln(os.Stderr, "-stdin-listen can't be used with -stdin-file or replay")
+			return 1
+		}
+		proxy.StdinListen = addr
+		proxy.StdoutToConn = *stdinListenStdoutFlag
+	} else if *stdinListenStdoutFlag {
+		fmt.Fprintln(os.Stderr, "-stdin-listen-stdout needs -stdin-listen")
+		return 1
+	}
+	if *eofSignalFlag != "" {
+		sig, err := stdiolog.EOFSignal(*eofSignalFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -eof-signal: %v\n", err)
+			return 1
+		}
+		proxy.EOFSignal = sig
+	}
+	if len(envs) > 0 {
+		for _, kv := range envs {
+			if !strings.Contains(kv, "=") {
+				fmt.Fprintf(os.Stderr, "Invalid -env %q: must be KEY=VALUE\n", kv)
+				return 1
+			}
+		}
+		// Later entries win, so these override inherited variables
+		proxy.Env = append(os.Environ(), envs...)
+	}
+	proxy.Dirs = strings.Split(*dirsFlag, ",")
+	if *dirsFlag == "" {
+		proxy.Dirs = []string{}
+	}
+	if *logEnvPrefixFlag != "" {
+		proxy.LogEnvPrefixes = strings.Split(*logEnvPrefixFlag, ",")
+	}
+	if *appendFlag != "" {
+		if *logFileFlag != "" {
+			fmt.Fprintln(os.Stderr, "-append and -log-file cannot be used together")
+			return 1
+		}
+		*logFileFlag = *appendFlag
+		proxy.SessionSeparator = true
+	}
 
-	// Start forwarding stdout
-	wg.Add(1)
-	go forwardAndLogStream(pipeStdout, os.Stdout, logFile, "out: ", &wg)
+	// With -fail-fast a missing program is reported before any log exists,
+	// with the shell's exit code for it
+	if *failFastFlag && !*checkFlag {
+		if _, args, err := proxy.Check(); err != nil {
+			var execErr *exec.Error
+			if args != nil && errors.As(err, &execErr) {
+				fmt.Fprintf(os.Stderr, "command not found: %s\n", execErr.Name)
+				return 127
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
 
-	// Start forwarding stderr
-	wg.Add(1)
-	go forwardAndLogStream(pipeStderr, os.Stderr, logFile, "err: ", &wg)
+	// Syslog falls back to the log file if it can't be reached
+	logDest := *logDestFlag
+	if !*checkFlag && (*syslogFlag || logDest == "syslog") {
+		sink, err := stdiolog.DialSyslog(*syslogFacilityFlag, *syslogTagFlag)
+		switch {
+		case err == nil:
+			defer sink.Close()
+			proxy.Syslog = sink
+		case logDest == "syslog":
+			log.Printf("Syslog unavailable, logging to file instead: %v", err)
+			logDest = "file"
+		default:
+			log.Printf("Syslog unavailable, logging to file only: %v", err)
+		}
+	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+	var logFiles []*stdiolog.LogFile
+	var checkPaths []string // log files -check reports instead of creating
+	var logPaths []string   // log files opened
+	defer func() {
+		for _, logFile := range logFiles {
+			if err := logFile.Close(); err != nil {
+				log.Printf("Error closing log file: %v", err)
+			}
+		}
+	}()
+	switch logDest {
+	case "syslog":
+		proxy.Log = io.Discard
+	case "stderr":
+		proxy.Log = os.Stderr
+	case "stdout":
+		proxy.Log = os.Stdout
+	case "file":
+		logFilePath := *logFileFlag
+		if logFilePath == "" {
+			// Place the default log file in -log-dir, or the first writable
+			// of the executable's, temp and current directories
+			dir := *logDirFlag
+			if dir == "" {
+				dir = defaultLogDir(*checkFlag)
+			} else if !*checkFlag {
+				if err := os.MkdirAll(dir, logDirPerm); err != nil {
+					log.Printf("Error creating log directory: %v", err)
+					return 1
+				}
+			}
+			if dir == "" {
+				log.Printf("No writable log directory, running without a log file")
+				proxy.Log = io.Discard
+				break
+			}
+			logFilePath = filepath.Join(dir, logFileName(now(), *labelFlag, fileRunID)) + stdiolog.CompressExt(*compressFlag)
+		} else if !*checkFlag {
+			if err := os.MkdirAll(filepath.Dir(logFilePath), logDirPerm); err != nil {
+				log.Printf("Error creating log directory: %v", err)
+				return 1
+			}
+		}
+
+		// rotatedPath names the file started by -rotate-interval at now: the
+		// default name with a new timestamp, or the custom path with the
+		// timestamp inserted
+		defaultPath := *logFileFlag == ""
+		rotatedPath := func(now time.Time) string {
+			if !defaultPath {
+				return stdiolog.WithInfix(logFilePath, now.UTC().Format(logTimestamp))
+			}
+			name := logFileName(now, *labelFlag, fileRunID) + stdiolog.CompressExt(*compressFlag)
+			return filepath.Join(filepath.Dir(logFilePath), name)
+		}
+
+		// openLog opens the log file, or with infix set one of the -split files
+		openLog := func(infix string) (io.Writer, error) {
+			withInfix := func(path string) string {
+				if infix == "" {
+					return path
+				}
+				return stdiolog.WithInfix(path, infix)
+			}
+			path := withInfix(logFilePath)
+			if *checkFlag {
+				checkPaths = append(checkPaths, path)
+				return io.Discard, nil
+			}
+			// Open log file in append mode
+			logFile, err := stdiolog.OpenLogFile(path, *compressFlag, *osyncFlag, logPerm, *maxSizeFlag*1024*1024)
+			if err != nil {
+				return nil, fmt.Errorf("creating log file: %w", err)
+			}
+			logFiles = append(logFiles, logFile)
+			if *rotateIntervalFlag > 0 {
+				logFile.RotateEvery(*rotateIntervalFlag, func(now time.Time) string {
+					return withInfix(rotatedPath(now))
+				})
+			}
+			if *maxSizeFlag > 0 || *rotateIntervalFlag > 0 {
+				if err := logFile.KeepManifest(manifestPath(path, *compressFlag)); err != nil {
+					return nil, fmt.Errorf("creating log manifest: %w", err)
+				}
+			}
+			logPaths = append(logPaths, path)
+			return logFile, nil
+		}
+		var err error
+		if *splitFlag {
+			proxy.Log, err = openLog("in")
+			if err == nil {
+				proxy.StdoutLog, err = openLog("out")
+			}
+			if err == nil {
+				proxy.StderrLog, err = openLog("err")
+			}
+		} else {
+			proxy.Log, err = openLog("")
+		}
+		if err != nil {
+			log.Printf("Error %v", err)
+			return 1
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -log-dest %q: must be file, stderr, stdout or syslog\n", *logDestFlag)
+		return 1
+	}
 
-	// Wait for the command to finish
-	exitCode := 0
-	if err := cmd.Wait(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
+	if *checkFlag {
+		path, args, err := proxy.Check()
+		if args == nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("command: %s %q\n", path, args[1:])
+		if len(checkPaths) > 0 {
+			fmt.Printf("log: %s\n", strings.Join(checkPaths, ", "))
 		} else {
-			log.Printf("Command finished with error: %v", err)
-			// Try to log the error too
-			_, logErr := logFile.WriteString(fmt.Sprintf("!!! Command Error: %v\n", err))
-			if logErr != nil {
-				log.Printf("Error writing to log file: %v", logErr)
+			fmt.Printf("log: %s\n", logDest)
+		}
+		if *syslogFlag {
+			fmt.Printf("syslog: %s, tag %s\n", *syslogFacilityFlag, *syslogTagFlag)
+		}
+		fmt.Printf("format: %s\n", *formatFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Command not found: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if *jsonrpcIndexFlag != "" {
+		if !*jsonrpcFlag && *framingFlag == "" {
+			fmt.Fprintln(os.Stderr, "-jsonrpc-index needs -jsonrpc or -framing")
+			return 1
+		}
+		indexFile, err := stdiolog.OpenLogFile(*jsonrpcIndexFlag, "none", *osyncFlag, logPerm, 0)
+		if err != nil {
+			log.Printf("Error creating -jsonrpc-index file: %v", err)
+			return 1
+		}
+		defer indexFile.Close()
+		proxy.JSONRPCIndex = indexFile
+	}
+
+	// Reopen the log files on SIGHUP, as log rotation tools expect, unless
+	// SIGHUP closes the command's stdin instead
+	if len(logFiles) > 0 && proxy.EOFSignal != syscall.SIGHUP {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		go func() {
+			for range hup {
+				for _, logFile := range logFiles {
+					if err := logFile.Reopen(); err != nil {
+						log.Printf("Error reopening log file: %v", err)
+					}
+				}
 			}
-			logFile.Sync()
-			exitCode = 1
+		}()
+	}
+
+	// openRaw creates a -stdout-file or -stderr-file, replacing any earlier one
+	openRaw := func(path string) *os.File {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, logPerm)
+		if err != nil {
+			log.Printf("Error creating raw stream file: %v", err)
+			return nil
 		}
+		return file
+	}
+	if *stdoutFileFlag != "" {
+		file := openRaw(*stdoutFileFlag)
+		if file == nil {
+			return 1
+		}
+		defer file.Close()
+		proxy.StdoutFile = file
+	}
+	if *stderrFileFlag != "" {
+		file := openRaw(*stderrFileFlag)
+		if file == nil {
+			return 1
+		}
+		defer file.Close()
+		proxy.StderrFile = file
 	}
 
-	// Ensure the process is terminated if it's still running (e.g., if logger crashed)
-	if cmd.Process != nil {
-		if err := cmd.Process.Kill(); err != nil {
-			log.Printf("Error killing process: %v", err)
+	// A tee that can't be opened is reported but doesn't stop the run
+	for _, dest := range tees {
+		tee, err := stdiolog.OpenTee(dest, logPerm)
+		if err != nil {
+			log.Printf("Error opening tee %s: %v", dest, err)
+			continue
 		}
+		defer tee.Close()
+		proxy.Tee = append(proxy.Tee, tee)
 	}
 
-	os.Exit(exitCode)
+	exitCode, err := proxy.Run(context.Background())
+	if err != nil {
+		log.Printf("Error: %v", err)
+	}
+	if *summaryJSONFlag != "" {
+		logFile := ""
+		if len(logPaths) > 0 {
+			logFile = logPaths[0]
+		}
+		if err := writeSummary(*summaryJSONFlag, proxy.Summary(), logFile); err != nil {
+			log.Printf("Error writing -summary-json: %v", err)
+		}
+	}
+	return exitCode
+}
+
+// writeSummary writes the -summary-json object for a run to path, or to
+// stderr if path is "-"
+func writeSummary(path string, summary stdiolog.Summary, logFile string) error {
+	type bytes struct {
+		In  int64 `json:"in"`
+		Out int64 `json:"out"`
+		Err int64 `json:"err"`
+	}
+	data, err := json.Marshal(struct {
+		ExitCode   int    `json:"exit_code"`
+		Signaled   bool   `json:"signaled"`
+		Bytes      bytes  `json:"bytes"`
+		DurationMS int64  `json:"duration_ms"`
+		LogFile    string `json:"log_file,omitempty"`
+	}{
+		ExitCode:   summary.ExitCode,
+		Signaled:   summary.Signaled,
+		Bytes:      bytes{In: summary.BytesIn, Out: summary.BytesOut, Err: summary.BytesErr},
+		DurationMS: summary.Duration.Milliseconds(),
+		LogFile:    logFile,
+	})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stderr.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/colinzhu/stdio-logger-go/stdiolog"
+)
+
+// replayEntry is one stdin entry read back from a log
+type replayEntry struct {
+	at   time.Time // zero if the timestamp could not be parsed
+	data string
+	pad  int // spaces after the text entry's "in:" label
+}
+
+// replayInput parses the arguments of the replay subcommand,
+//
+//	replay [-speed N] [-time-format layout] <logfile> -- [flags] <command> [args...]
+//
+// and returns a reader replaying the stdin entries of the log, along with
+// the arguments after "--" to run the new child with
+func replayInput(args []string) (io.Reader, []string, error) {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := fs.Float64("speed", 0, "replay with the original timing between entries sped up by this factor, e.g. 1 for real time (0 replays without delays)")
+	timeFormat := fs.String("time-format", stdiolog.DefaultTimeFormat, "Go time layout of the log's timestamps")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() < 3 || fs.Arg(1) != "--" {
+		return nil, nil, fmt.Errorf("usage: replay [-speed N] <logfile> -- [flags] <command> [args...]")
+	}
+	if *speed < 0 {
+		return nil, nil, fmt.Errorf("invalid -speed %v: must not be negative", *speed)
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	entries, err := parseStdinEntries(file, *timeFormat)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", fs.Arg(0), err)
+	}
+	if len(entries) == 0 {
+		return nil, nil, fmt.Errorf("no stdin entries found in %s", fs.Arg(0))
+	}
+	return replayReader(entries, *speed), fs.Args()[2:], nil
+}
+
+// entryFields matches the optional -hostname-lines, -label and -ids fields
+// and the stdin label, with any -align padding and -annotate field, that
+// start a stdin text entry. The padding is spaces only, so the newline of
+// an empty line stays data.
+var entryFields = regexp.MustCompile(`^(?:host=\S+ )?(?:label=\S+ )?(?:pid=\d+ session=\S* )?in:( +)(?:\[len=\d+ crc=[0-9a-f]{8}\] )?`)
+
+// seqField matches the sequence number -seq starts text lines with
+var seqField = regexp.MustCompile(`^\d+ `)
+
+// csvHeader is the first line of a csv format log
+const csvHeader = "timestamp,direction,bytes,data\n"
+
+// parseStdinEntries reads back the stdin entries of a text, json or csv
+// log, inverting the format streamLog writes. Text lines of a timestamped
+// log that don't start with a timestamp continue the previous entry;
+// without timestamps each line is an entry of its own.
+func parseStdinEntries(r io.Reader, timeFormat string) ([]replayEntry, error) {
+	reader := bufio.NewReader(r)
+	if header, _ := reader.Peek(len(csvHeader)); string(header) == csvHeader {
+		return parseCSVEntries(reader, timeFormat)
+	}
+	var entries []replayEntry
+	var current *replayEntry // the text stdin entry still being read
+	var stamped bool         // whether current had a timestamp, so can go on
+	finish := func() {
+		if current != nil {
+			if data, ok := strings.CutSuffix(current.data, "␊(no-nl)\n"); ok {
+				current.data = data
+			}
+			entries = append(entries, *current)
+			current = nil
+		}
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if seq := seqField.FindString(line); seq != "" && startsEntry(line[len(seq):], timeFormat) {
+			line = line[len(seq):]
+		}
+		if line != "" {
+			if strings.HasPrefix(line, "{") {
+				finish()
+				var record struct{ TS, Dir, Data string }
+				if json.Unmarshal([]byte(line), &record) == nil && record.Dir == "in" {
+					at, _ := time.Parse(timeFormat, record.TS)
+					entries = append(entries, replayEntry{at: at, data: record.Data})
+				}
+			} else if ts, rest, _ := strings.Cut(line, " "); isTimestamp(ts, timeFormat) {
+				finish()
+				if fields := entryFields.FindStringSubmatch(rest); fields != nil {
+					at, _ := time.Parse(timeFormat, ts)
+					current, stamped = &replayEntry{at: at, data: rest[len(fields[0]):], pad: len(fields[1])}, true
+				}
+			} else if fields := entryFields.FindStringSubmatch(line); fields != nil {
+				// Logged with -no-timestamp
+				finish()
+				current, stamped = &replayEntry{data: line[len(fields[0]):], pad: len(fields[1])}, false
+			} else if current != nil && stamped {
+				current.data += line
+			} else {
+				finish()
+			}
+		}
+		if err == io.EOF {
+			finish()
+			return unpad(entries), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// startsEntry reports whether a text log line, after any sequence number,
+// starts with a timestamp or a stdin entry
+func startsEntry(line, timeFormat string) bool {
+	ts, _, _ := strings.Cut(line, " ")
+	return isTimestamp(ts, timeFormat) || entryFields.MatchString(line)
+}
+
+// unpad gives back the leading spaces of text entries' data that
+// entryFields took for padding. -align pads the label to the same width
+// throughout the log, so spaces past the narrowest padding are data.
+func unpad(entries []replayEntry) []replayEntry {
+	pad := 0
+	for _, entry := range entries {
+		if entry.pad > 0 && (pad == 0 || entry.pad < pad) {
+			pad = entry.pad
+		}
+	}
+	for i, entry := range entries {
+		if entry.pad > pad {
+			entries[i].data = strings.Repeat(" ", entry.pad-pad) + entry.data
+		}
+	}
+	return entries
+}
+
+// parseCSVEntries reads back the stdin records of a csv log, which starts
+// with its header record
+func parseCSVEntries(r io.Reader, timeFormat string) ([]replayEntry, error) {
+	records := csv.NewReader(r)
+	records.FieldsPerRecord = 4
+	var entries []replayEntry
+	for {
+		record, err := records.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record[1] == "in" {
+			at, _ := time.Parse(timeFormat, record[0])
+			entries = append(entries, replayEntry{at: at, data: record[3]})
+		}
+	}
+}
+
+func isTimestamp(s, layout string) bool {
+	_, err := time.Parse(layout, s)
+	return err == nil
+}
+
+// replayReader returns a reader yielding the entries' data in turn. With
+// speed set it waits the time between entries divided by speed first.
+func replayReader(entries []replayEntry, speed float64) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		for i, entry := range entries {
+			if speed > 0 && i > 0 && !entry.at.IsZero() && !entries[i-1].at.IsZero() {
+				time.Sleep(time.Duration(float64(entry.at.Sub(entries[i-1].at)) / speed))
+			}
+			if _, err := io.WriteString(w, entry.data); err != nil {
+				return
+			}
+		}
+		w.Close()
+	}()
+	return r
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/colinzhu/stdio-logger-go/stdiolog"
+)
+
+func TestParseStdinEntries(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat not found")
+	}
+	const input = "first\n  indented\n\nlast"
+	tests := []struct {
+		name string
+		p    stdiolog.Proxy
+	}{
+		{"text", stdiolog.Proxy{}},
+		{"json", stdiolog.Proxy{Format: "json"}},
+		{"csv", stdiolog.Proxy{Format: "csv"}},
+		{"csv without timestamps", stdiolog.Proxy{Format: "csv", NoTimestamp: true}},
+		{"seq", stdiolog.Proxy{Seq: true}},
+		{"no timestamp", stdiolog.Proxy{NoTimestamp: true}},
+		{"seq no timestamp", stdiolog.Proxy{Seq: true, NoTimestamp: true}},
+		{"align", stdiolog.Proxy{AlignPrefixes: true, Prefixes: &stdiolog.Prefixes{Stdout: "stdout: ", Stderr: "stderr: "}}},
+		{"annotate", stdiolog.Proxy{Annotate: true}},
+		{"ids", stdiolog.Proxy{LineIDs: true, Label: "test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			p := tt.p
+			p.Command, p.NoShell = "cat", true
+			p.Log, p.Stdin, p.Stdout, p.Stderr = &log, strings.NewReader(input), &bytes.Buffer{}, &bytes.Buffer{}
+			if exitCode, err := p.Run(context.Background()); err != nil || exitCode != 0 {
+				t.Fatalf("Run = %d, %v", exitCode, err)
+			}
+			entries, err := parseStdinEntries(&log, stdiolog.DefaultTimeFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got strings.Builder
+			for _, entry := range entries {
+				got.WriteString(entry.data)
+			}
+			if got.String() != input {
+				t.Errorf("replayed %q, want %q", got.String(), input)
+			}
+		})
+	}
+}
+
+func TestReplayInputWithoutStdin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.log")
+	if err := os.WriteFile(path, []byte("2024-01-02T03:04:05.000Z out: hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := replayInput([]string{path, "--", "cat"}); err == nil || !strings.Contains(err.Error(), "no stdin entries") {
+		t.Errorf("replayInput = %v, want an error for no stdin entries", err)
+	}
+}
@@ -0,0 +1,63 @@
+package stdiolog
+
+// ansiStripper removes ANSI/VT escape sequences from logged data. It is a
+// small state machine, so a sequence split across two entries is still
+// removed whole.
+type ansiStripper struct {
+	state ansiState
+}
+
+type ansiState int
+
+const (
+	ansiGround    ansiState = iota
+	ansiEscape              // after ESC
+	ansiCSI                 // in a control sequence, ESC [
+	ansiString              // in an OSC, DCS, SOS, PM or APC string
+	ansiStringEsc           // after ESC in a string, which ends it at "\"
+)
+
+const esc = 0x1b
+
+// strip returns data without the escape sequences in it
+func (a *ansiStripper) strip(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		switch a.state {
+		case ansiGround:
+			if b == esc {
+				a.state = ansiEscape
+			} else {
+				out = append(out, b)
+			}
+		case ansiEscape:
+			switch {
+			case b == '[':
+				a.state = ansiCSI
+			case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+				a.state = ansiString
+			case b >= 0x20 && b <= 0x2f:
+				// intermediate byte, the sequence goes on
+			default:
+				a.state = ansiGround
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				a.state = ansiGround
+			}
+		case ansiString:
+			if b == 0x07 {
+				a.state = ansiGround
+			} else if b == esc {
+				a.state = ansiStringEsc
+			}
+		case ansiStringEsc:
+			if b == '\\' {
+				a.state = ansiGround
+			} else if b != esc {
+				a.state = ansiString
+			}
+		}
+	}
+	return out
+}
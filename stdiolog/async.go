@@ -0,0 +1,76 @@
+package stdiolog
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+)
+
+// asyncLog hands log entries to a goroutine that writes them out, so a slow
+// log never holds up forwarding. When its queue is full the oldest entry is
+// dropped, and the number dropped is logged before the next one written.
+type asyncLog struct {
+	w        io.Writer
+	queue    chan []byte
+	finished chan struct{}
+	dropped  atomic.Int64
+	marker   func(event, text string) string // formats the dropped entries marker
+}
+
+func newAsyncLog(w io.Writer, size int) *asyncLog {
+	a := &asyncLog{w: w, queue: make(chan []byte, size), finished: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+// Write queues a copy of one entry, dropping the oldest queued entry if
+// there is no room. It never blocks.
+func (a *asyncLog) Write(p []byte) (int, error) {
+	entry := append([]byte(nil), p...)
+	for {
+		select {
+		case a.queue <- entry:
+			return len(p), nil
+		default:
+		}
+		select {
+		case <-a.queue:
+			a.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// run writes out queued entries until the queue is closed, syncing the log
+// whenever it catches up
+func (a *asyncLog) run() {
+	defer close(a.finished)
+	failed := false
+	write := func(entry []byte) {
+		if _, err := a.w.Write(entry); err != nil && !failed {
+			log.Printf("Error writing to log file: %v", err)
+			failed = true
+		}
+	}
+	for entry := range a.queue {
+		if n := a.dropped.Swap(0); n > 0 && a.marker != nil {
+			write([]byte(a.marker("log_entries_dropped", fmt.Sprintf("%d log entries dropped", n))))
+		}
+		write(entry)
+		if len(a.queue) == 0 {
+			syncWriter(a.w)
+		}
+	}
+	if n := a.dropped.Swap(0); n > 0 && a.marker != nil {
+		write([]byte(a.marker("log_entries_dropped", fmt.Sprintf("%d log entries dropped", n))))
+		syncWriter(a.w)
+	}
+}
+
+// close writes out the entries still queued and stops the writer. Nothing
+// may be written afterwards.
+func (a *asyncLog) close() {
+	close(a.queue)
+	<-a.finished
+}
@@ -0,0 +1,93 @@
+package stdiolog
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// batchSize is how many bytes a batchedLog buffers before writing them out
+// ahead of the next flush
+const batchSize = 64 * 1024
+
+// batchedLog buffers log entries in memory and flushes them to the
+// underlying writer periodically rather than after every entry, which avoids
+// an fsync per read on chatty streams. Entries are only ever written out
+// whole, so a rotating log never splits one across two files.
+type batchedLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func newBatchedLog(w io.Writer) *batchedLog {
+	return &batchedLog{w: w}
+}
+
+// Write buffers one entry, first writing out the buffer if the entry would
+// overflow it
+func (b *batchedLog) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf.Len() > 0 && b.buf.Len()+len(p) > batchSize {
+		if err := b.writeOut(); err != nil {
+			return 0, err
+		}
+	}
+	return b.buf.Write(p)
+}
+
+// writeOut writes the buffered entries in a single write. Callers must hold
+// b.mu.
+func (b *batchedLog) writeOut() error {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+	_, err := b.w.Write(b.buf.Bytes())
+	b.buf.Reset()
+	return err
+}
+
+// flush writes out buffered entries and syncs the underlying writer
+func (b *batchedLog) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.writeOut(); err != nil {
+		return err
+	}
+	return syncWriter(b.w)
+}
+
+// flushEvery flushes logs every interval until the returned stop function is
+// called, which performs a final flush
+func flushEvery(interval time.Duration, logs []*batchedLog) (stop func()) {
+	flushAll := func() {
+		for _, l := range logs {
+			if err := l.flush(); err != nil {
+				log.Printf("Error flushing log file: %v", err)
+			}
+		}
+	}
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				flushAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-finished
+		flushAll()
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package stdiolog
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenPipe reports whether err comes from writing to a pipe whose
+// reader has gone away
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
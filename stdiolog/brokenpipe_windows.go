@@ -0,0 +1,16 @@
+package stdiolog
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNoData is ERROR_NO_DATA, "The pipe is being closed", which writes to
+// a pipe fail with once its reader has closed it
+const errorNoData syscall.Errno = 232
+
+// isBrokenPipe reports whether err comes from writing to a pipe whose
+// reader has gone away
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.ERROR_BROKEN_PIPE) || errors.Is(err, errorNoData) || errors.Is(err, syscall.EPIPE)
+}
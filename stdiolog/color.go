@@ -0,0 +1,46 @@
+package stdiolog
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+// colorWriter wraps everything written to w in an ANSI color, resetting it
+// before a trailing newline so the color doesn't bleed into the next line
+type colorWriter struct {
+	w     io.Writer
+	color string
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	text, newline := bytes.CutSuffix(p, []byte("\n"))
+	out := make([]byte, 0, len(p)+len(c.color)+len(colorReset))
+	out = append(out, c.color...)
+	out = append(out, text...)
+	out = append(out, colorReset...)
+	if newline {
+		out = append(out, '\n')
+	}
+	if _, err := c.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useColor reports whether colored output should be written to w: only to a
+// terminal, and never when the NO_COLOR convention asks for plain output
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
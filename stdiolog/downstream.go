@@ -0,0 +1,54 @@
+package stdiolog
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// downstreamWriter forwards the child's stdout to the proxy's stdout and
+// notices when whatever reads it goes away, as when the proxy is piped into
+// head. The first broken pipe is logged and closes closed; from then on
+// output is dropped rather than failing every write, and is still logged.
+type downstreamWriter struct {
+	w        io.Writer
+	logger   *streamLog
+	shutdown bool // the child is shut down once closed, per Proxy.StopOnStdoutClose
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newDownstreamWriter(w io.Writer, logger *streamLog, shutdown bool) *downstreamWriter {
+	return &downstreamWriter{w: w, logger: logger, shutdown: shutdown, closed: make(chan struct{})}
+}
+
+func (d *downstreamWriter) Write(b []byte) (int, error) {
+	if d.isClosed() {
+		return len(b), nil
+	}
+	n, err := d.w.Write(b)
+	if err == nil || !isBrokenPipe(err) {
+		return n, err
+	}
+	d.once.Do(func() {
+		text := "proxy stdout closed, continuing"
+		if d.shutdown {
+			text = "proxy stdout closed, shutting down"
+		}
+		if err := d.logger.marker("stdout_closed", text); err != nil {
+			log.Printf("Error writing to log file: %v", err)
+		}
+		close(d.closed)
+	})
+	return len(b), nil
+}
+
+// isClosed reports whether the proxy's stdout has been found closed
+func (d *downstreamWriter) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
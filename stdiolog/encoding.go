@@ -0,0 +1,72 @@
+package stdiolog
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// newDecoder returns the transformer that converts output in the named
+// encoding to UTF-8 for the log: "utf16le" and "utf16be", which honour a BOM
+// if there is one, or "auto" to decode UTF-16 only when the stream starts
+// with a BOM
+func newDecoder(encoding string) (transform.Transformer, error) {
+	switch encoding {
+	case "utf16le":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder(), nil
+	case "utf16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder(), nil
+	case "auto":
+		return unicode.BOMOverride(transform.Nop), nil
+	}
+	return nil, fmt.Errorf("invalid encoding %q: must be utf16le, utf16be or auto", encoding)
+}
+
+// lineLog logs the data written to it one line per entry
+type lineLog struct {
+	logger      *streamLog
+	dir, prefix string
+	lines       lineBuffer
+}
+
+func (w *lineLog) Write(p []byte) (int, error) {
+	for _, line := range w.lines.feed(p) {
+		if w.logger.wanted(line) {
+			w.logger.entry(w.dir, w.prefix, line, true)
+		}
+	}
+	return len(p), nil
+}
+
+// Close logs the incomplete line left when the stream ends
+func (w *lineLog) Close() error {
+	if rest := w.lines.rest(); len(rest) > 0 && w.logger.wanted(rest) {
+		return w.logger.entry(w.dir, w.prefix, w.logger.markNoNewline(rest), true)
+	}
+	return nil
+}
+
+// forwardDecoded forwards target to proxy unchanged while logging it decoded
+// from the logger's encoding, one entry per decoded line. It returns the
+// error that ended the stream.
+func forwardDecoded(target io.Reader, proxy io.Writer, logger *streamLog, dir, prefix string) error {
+	decoder, _ := newDecoder(logger.encoding) // validated by Run
+	lines := &lineLog{logger: logger, dir: dir, prefix: prefix}
+	decoded := transform.NewWriter(lines, decoder)
+	buffer := make([]byte, logger.readSize())
+	for {
+		n, err := target.Read(buffer)
+		if n > 0 {
+			decoded.Write(buffer[:n])
+			// write to proxy
+			proxy.Write(buffer[:n])
+		}
+		if err != nil {
+			decoded.Close() // flushes the decoder, leaving lines open
+			lines.Close()
+			return err
+		}
+	}
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package stdiolog
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// exitSignal returns the signal that terminated the child, if any
+func exitSignal(exitError *exec.ExitError) (syscall.Signal, bool) {
+	status, ok := exitError.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+// crashSignals name the signals that mean the child crashed rather than was
+// asked to stop
+var crashSignals = map[syscall.Signal]string{
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+// crashMarker returns the marker text for a child killed by a crash signal,
+// noting whether it dumped core
+func crashMarker(exitError *exec.ExitError) (string, bool) {
+	status, ok := exitError.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", false
+	}
+	name, ok := crashSignals[status.Signal()]
+	if !ok {
+		return "", false
+	}
+	text := "child crashed: signal=" + name
+	if status.CoreDump() {
+		text += " (core dumped)"
+	}
+	return text, true
+}
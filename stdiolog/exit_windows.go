@@ -0,0 +1,17 @@
+package stdiolog
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// exitSignal always reports false, as Windows processes are not terminated
+// by signals
+func exitSignal(exitError *exec.ExitError) (syscall.Signal, bool) {
+	return 0, false
+}
+
+// crashMarker always reports false, as crashes are not told apart on Windows
+func crashMarker(exitError *exec.ExitError) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,461 @@
+package stdiolog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// defaultBufferSize is the read buffer size unless Proxy.BufferSize is set
+	defaultBufferSize = 4096
+	// maxBufferSize is the largest Proxy.BufferSize accepted
+	maxBufferSize = 16 << 20
+)
+
+// readSize returns the size of the buffer to read the logger's stream with
+func (l *streamLog) readSize() int {
+	if l.bufferSize > 0 {
+		return l.bufferSize
+	}
+	return defaultBufferSize
+}
+
+// errStdinEOFSignal ends stdin forwarding when the EOF signal arrives
+var errStdinEOFSignal = errors.New("closed on signal")
+
+const (
+	// zeroReadBackoff is how many reads in a row may return no data and no
+	// error before progressReader starts pausing between them
+	zeroReadBackoff = 100
+	// maxZeroReads is how many such reads in a row end the stream
+	maxZeroReads = 1000
+	// zeroReadPause is the pause between reads once backing off
+	zeroReadPause = 10 * time.Millisecond
+)
+
+// progressReader guards the forwarding loops against a reader that keeps
+// returning no data and no error, which would make them spin. It retries
+// such reads itself, pausing between them after zeroReadBackoff in a row,
+// when it logs a marker, and failing with io.ErrNoProgress after
+// maxZeroReads.
+type progressReader struct {
+	r      io.Reader
+	logger *streamLog
+	stream string // "stdin", "stdout" or "stderr", for the marker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	for empty := 1; ; empty++ {
+		n, err := p.r.Read(b)
+		if n > 0 || err != nil || len(b) == 0 {
+			return n, err
+		}
+		switch {
+		case empty == maxZeroReads:
+			return 0, io.ErrNoProgress
+		case empty == zeroReadBackoff:
+			if err := p.logger.marker("no_progress", p.stream+" reads returning no data, backing off"); err != nil {
+				log.Printf("Error writing to log file: %v", err)
+			}
+			fallthrough
+		case empty > zeroReadBackoff:
+			time.Sleep(zeroReadPause)
+		}
+	}
+}
+
+// readResult is the outcome of one Read call on the proxy's stdin
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// readChunks reads from r, size bytes at a time, in a separate goroutine so
+// callers can stop waiting on a blocked Read. It stops once a read fails or
+// done is closed. Data returned along with an error comes in the same
+// result, and callers handle it before the error.
+func readChunks(r io.Reader, size int, done <-chan struct{}) <-chan readResult {
+	results := make(chan readResult)
+	go func() {
+		defer close(results)
+		buffer := make([]byte, size) // Use buffer for efficient reading
+		for {
+			n, err := r.Read(buffer)
+			result := readResult{data: append([]byte(nil), buffer[:n]...), err: err}
+			select {
+			case results <- result:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
+// writeWithTimeout writes data to w, giving up once timeout has passed if it
+// is non-zero. The write is left running in the background when it times out.
+func writeWithTimeout(w io.Writer, data []byte, timeout time.Duration) (timedOut bool, err error) {
+	if timeout <= 0 {
+		_, err := w.Write(data)
+		return false, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		return true, nil
+	}
+}
+
+// incompleteRune returns how many bytes at the end of data start a UTF-8
+// character that is not complete yet, as when a read ends in the middle of
+// one, or 0 if data ends on a character boundary
+func incompleteRune(data []byte) int {
+	for i := 1; i <= min(len(data), utf8.UTFMax-1); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+// lineBuffer collects chunks read from a stream into complete lines
+type lineBuffer struct {
+	buf []byte
+}
+
+// feed adds data and returns the lines it completes, newline included
+func (b *lineBuffer) feed(data []byte) [][]byte {
+	b.buf = append(b.buf, data...)
+	var lines [][]byte
+	for {
+		i := bytes.IndexByte(b.buf, '\n')
+		if i < 0 {
+			return lines
+		}
+		lines = append(lines, b.buf[:i+1:i+1])
+		b.buf = b.buf[i+1:]
+	}
+}
+
+// rest returns and clears the incomplete line left over
+func (b *lineBuffer) rest() []byte {
+	rest := b.buf
+	b.buf = nil
+	return rest
+}
+
+// forwardAndLogStdin reads chunks of proxy's stdin from input, logs them, and
+// writes them to target's stdin. It returns once proxy's stdin closes or ctx
+// is cancelled, or a write to the target blocks longer than writeTimeout,
+// closing target's stdin. With keepOpen set target's stdin instead stays open
+// after proxy's stdin closes, until ctx is cancelled. A signal on eof closes
+// it at once. Unless raw is set, or the logger is in binary or JSON-RPC
+// mode, the log gets one entry per line rather than per chunk read; data is
+// still forwarded as soon as it is read.
+func forwardAndLogStdin(ctx context.Context, input <-chan readResult, targetStdin io.WriteCloser, logger *streamLog, raw bool, writeTimeout time.Duration, keepOpen bool, eof <-chan os.Signal, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var lines *lineBuffer
+	if !raw && !logger.binary && logger.rpc == nil {
+		lines = &lineBuffer{}
+	}
+	// partial holds a character split by the last read in raw text mode, to
+	// be logged whole with the next chunk so the log stays valid UTF-8
+	var partial []byte
+
+	for {
+		var result readResult
+		select {
+		case chunk, ok := <-input:
+			result = chunk
+			if !ok {
+				// An earlier run of the child already saw stdin end
+				result.err = io.EOF
+			}
+		case <-ctx.Done():
+			result.err = ctx.Err()
+		case sig := <-eof:
+			if err := logger.marker("stdin_eof_signal", "closing target stdin on "+sig.String()); err != nil {
+				log.Printf("Error writing to log file: %v", err)
+			}
+			result.err = errStdinEOFSignal
+		}
+		data, err := result.data, result.err
+		if len(data) > 0 {
+			// Write to log file with ISO timestamp and "in:  " prefix
+			if logger.rpc != nil {
+				logger.frames("in", "in:  ", data)
+			} else if lines != nil {
+				for _, line := range lines.feed(data) {
+					if logErr := logger.entry("in", "in:  ", logger.ndjsonLine(line), false); logErr != nil {
+						log.Printf("Error writing to log file: %v", logErr)
+					}
+				}
+			} else {
+				logged := data
+				if !logger.binary {
+					logged = append(partial, data...)
+					n := incompleteRune(logged)
+					logged, partial = logged[:len(logged)-n], bytes.Clone(logged[len(logged)-n:])
+				}
+				if len(logged) > 0 {
+					if logErr := logger.entry("in", "in:  ", logged, false); logErr != nil {
+						log.Printf("Error writing to log file: %v", logErr)
+					}
+				}
+			}
+
+			// Write to target process stdin
+			timedOut, writeErr := writeWithTimeout(targetStdin, data, writeTimeout)
+			if timedOut {
+				// The child stopped reading; closing its stdin below unblocks the write
+				log.Printf("Writing to target stdin timed out after %v", writeTimeout)
+				if logErr := logger.marker("stdin_write_timeout", "target stdin write timed out"); logErr != nil {
+					log.Printf("Error writing to log file: %v", logErr)
+				}
+				break
+			}
+			if writeErr != nil {
+				log.Printf("Error writing to target stdin: %v", writeErr)
+				break
+			}
+		}
+
+		if err != nil {
+			// Once ctx is done the child has exited, which is not a stdin failure
+			if ctx.Err() == nil && err != errStdinEOFSignal {
+				if err != io.EOF {
+					log.Printf("STDIN Forwarding Error: %v", err)
+				}
+				logClosed(logger, "stdin", err)
+				if err == io.EOF && keepOpen {
+					// Leave the child's stdin open until it exits or is signalled
+					select {
+					case <-ctx.Done():
+					case sig := <-eof:
+						if err := logger.marker("stdin_eof_signal", "closing target stdin on "+sig.String()); err != nil {
+							log.Printf("Error writing to log file: %v", err)
+						}
+					}
+				}
+			}
+			break
+		}
+	}
+
+	if logger.rpc != nil {
+		logger.flushFrames("in", "in:  ")
+	}
+	if len(partial) > 0 {
+		// The stream ended mid-character, so log what there is
+		if err := logger.entry("in", "in:  ", partial, false); err != nil {
+			log.Printf("Error writing to log file: %v", err)
+		}
+	}
+	if lines != nil {
+		if rest := lines.rest(); len(rest) > 0 {
+			if err := logger.entry("in", "in:  ", logger.markNoNewline(rest), true); err != nil {
+				log.Printf("Error writing to log file: %v", err)
+			}
+		}
+	}
+
+	// Close target stdin when proxy stdin closes
+	// (cmd.Wait may already have closed it if the child exited first)
+	if closeErr := targetStdin.Close(); closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+		log.Printf("Error closing target stdin: %v", closeErr)
+	}
+	if err := logger.marker("stdin_closed", "STDIN stream closed to target"); err != nil {
+		log.Printf("Error writing to log file: %v", err)
+	}
+}
+
+// streamGroup waits for the output forwarders, keeping track of the
+// streams, named by their dir, that have not ended yet
+type streamGroup struct {
+	sync.WaitGroup
+	mu      sync.Mutex
+	streams []string
+}
+
+// add counts in the forwarder of stream dir
+func (g *streamGroup) add(dir string) {
+	g.mu.Lock()
+	g.streams = append(g.streams, streamName(dir))
+	g.mu.Unlock()
+	g.Add(1)
+}
+
+// done records that the forwarder of stream dir has returned
+func (g *streamGroup) done(dir string) {
+	g.mu.Lock()
+	if i := slices.Index(g.streams, streamName(dir)); i >= 0 {
+		g.streams = slices.Delete(g.streams, i, i+1)
+	}
+	g.mu.Unlock()
+	g.Done()
+}
+
+// open returns the streams whose forwarders are still running
+func (g *streamGroup) open() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Clone(g.streams)
+}
+
+// forwardAndLogStream reads from target's stdout/stderr, logs it, and writes to proxy's stdout.
+// Cancelling ctx closes target, if it is a Closer, to unblock the pending read.
+// dir names the stream in json entries and prefix labels its text entries.
+// Once the stream ends a marker records whether it closed or failed.
+func forwardAndLogStream(ctx context.Context, target io.Reader, proxy io.Writer, logger *streamLog, dir, prefix string, wg *streamGroup) {
+	defer wg.done(dir)
+	if closer, ok := target.(io.Closer); ok {
+		stop := context.AfterFunc(ctx, func() { closer.Close() })
+		defer stop()
+	}
+	target = &progressReader{r: target, logger: logger, stream: streamName(dir)}
+	var err error
+	switch {
+	case logger.binary || logger.rpc != nil:
+		err = forwardBlocks(target, proxy, logger, dir, prefix)
+	case logger.encoding != "":
+		err = forwardDecoded(target, proxy, logger, dir, prefix)
+	default:
+		err = forwardLines(target, proxy, logger, dir, prefix)
+	}
+	if ctx.Err() != nil && errors.Is(err, os.ErrClosed) {
+		err = io.EOF // closed above on cancellation
+	}
+	logClosed(logger, streamName(dir), err)
+}
+
+// streamName names the stream of direction dir in markers: "stdout" for
+// "out", but an extra descriptor's "fd3" as is
+func streamName(dir string) string {
+	if strings.HasPrefix(dir, "fd") {
+		return dir
+	}
+	return "std" + dir
+}
+
+// logClosed records how a stream ended: "closed (EOF)" or "read error",
+// as the <stream>_eof or <stream>_read_error event
+func logClosed(logger *streamLog, stream string, err error) {
+	event, text := stream+"_eof", stream+" closed (EOF)"
+	if err != io.EOF {
+		event, text = stream+"_read_error", fmt.Sprintf("%s read error: %v", stream, err)
+	}
+	if logErr := logger.marker(event, text); logErr != nil {
+		log.Printf("Error writing to log file: %v", logErr)
+	}
+}
+
+// forwardBlocks forwards and logs binary and framed data, which has no line
+// structure, in fixed-size blocks. It returns the error that ended the stream.
+func forwardBlocks(target io.Reader, proxy io.Writer, logger *streamLog, dir, prefix string) error {
+	buffer := make([]byte, logger.readSize())
+	for {
+		n, err := target.Read(buffer)
+		// A read may return data with the error that ends the stream, so the
+		// data is handled first
+		if n > 0 {
+			if logger.rpc != nil {
+				logger.frames(dir, prefix, buffer[:n])
+			} else {
+				logger.entry(dir, prefix, buffer[:n], true)
+			}
+			// write to proxy
+			proxy.Write(buffer[:n])
+		}
+		if err != nil {
+			if logger.rpc != nil {
+				logger.flushFrames(dir, prefix)
+			}
+			return err
+		}
+	}
+}
+
+// forwardLines forwards text as it arrives and logs it one line per entry.
+// It returns the error that ended the stream.
+func forwardLines(target io.Reader, proxy io.Writer, logger *streamLog, dir, prefix string) error {
+	reader := bufio.NewReaderSize(target, logger.readSize())
+	// line collects the logged part of the current line. With maxLine set it is
+	// capped and the excess only counted, so long lines use bounded memory.
+	var line []byte
+	truncated := 0
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if len(fragment) > 0 {
+			keep := len(fragment)
+			if truncated > 0 {
+				keep = 0 // the line was cut, the rest of it is only counted
+			} else if logger.maxLine > 0 {
+				keep = max(0, min(keep, logger.maxLine-len(line)))
+			}
+			line = append(line, fragment[:keep]...)
+			truncated += len(fragment) - keep
+			if keep < len(fragment) {
+				// Cut at a character boundary, counting the rest as truncated
+				n := incompleteRune(line)
+				line, truncated = line[:len(line)-n], truncated+n
+			}
+			// write to proxy
+			proxy.Write(fragment)
+		}
+		if err == bufio.ErrBufferFull {
+			continue // the line goes on, keep reading it
+		}
+		// A line cut before its first character still logs the marker
+		if len(line) > 0 || truncated > 0 {
+			if truncated > 0 {
+				if err == nil {
+					truncated-- // the dropped newline is not content
+				}
+				line = fmt.Appendf(line, " …[truncated %d bytes]", truncated)
+			} else {
+				line = logger.ndjsonLine(line)
+			}
+			if err != nil {
+				// ReadSlice only fails before finding a newline, so the stream ended mid-line
+				line = logger.markNoNewline(line)
+			}
+			label := prefix
+			if prefix != "" && strings.HasPrefix(string(line), prefix+" ") {
+				// already has prefix, write log directly (still add timestamp)
+				label = ""
+			}
+			if logger.wanted(line) {
+				logger.entry(dir, label, line, true)
+			}
+			line, truncated = line[:0], 0
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
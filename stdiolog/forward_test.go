@@ -0,0 +1,267 @@
+package stdiolog
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// testLogger returns a logger for p writing untimestamped entries to the
+// returned buffer
+func testLogger(p *Proxy) (*streamLog, *bytes.Buffer) {
+	p.NoTimestamp = true
+	var log bytes.Buffer
+	return p.newLogger(&log, &sync.Mutex{}), &log
+}
+
+// closeBuffer is a child's stdin that records what it was sent
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestForwardLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"line", "hi\n", "out: hi\n"},
+		{"lines", "a\nb\n", "out: a\nout: b\n"},
+		{"partial line", "hi", "out: hi␊(no-nl)\n"},
+		{"partial last line", "a\nb", "out: a\nout: b␊(no-nl)\n"},
+		{"already prefixed", "out:  hi\n", "out:  hi\n"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, log := testLogger(&Proxy{})
+			var forwarded bytes.Buffer
+			err := forwardLines(strings.NewReader(tt.input), &forwarded, logger, "out", "out: ")
+			if err != io.EOF {
+				t.Errorf("err = %v, want io.EOF", err)
+			}
+			if got := log.String(); got != tt.want {
+				t.Errorf("log = %q, want %q", got, tt.want)
+			}
+			if forwarded.String() != tt.input {
+				t.Errorf("forwarded %q, want %q", forwarded.String(), tt.input)
+			}
+		})
+	}
+}
+
+func TestForwardAndLogStreamClosedMarker(t *testing.T) {
+	logger, log := testLogger(&Proxy{})
+	var wg streamGroup
+	wg.add("out")
+	forwardAndLogStream(context.Background(), strings.NewReader("hi\n"), io.Discard, logger, "out", "out: ", &wg)
+	if want := "out: hi\n--- stdout closed (EOF) ---\n"; log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+	if open := wg.open(); len(open) != 0 {
+		t.Errorf("streams still open: %v", open)
+	}
+}
+
+// runStdin feeds chunks to forwardAndLogStdin, ending with EOF, and returns
+// what the child was sent
+func runStdin(t *testing.T, logger *streamLog, raw bool, chunks ...string) string {
+	t.Helper()
+	input := make(chan readResult, len(chunks)+1)
+	for _, chunk := range chunks {
+		input <- readResult{data: []byte(chunk)}
+	}
+	input <- readResult{err: io.EOF}
+	var stdin closeBuffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	forwardAndLogStdin(context.Background(), input, &stdin, logger, raw, 0, false, nil, &wg)
+	if !stdin.closed {
+		t.Error("child's stdin was not closed")
+	}
+	return stdin.String()
+}
+
+func TestForwardAndLogStdin(t *testing.T) {
+	const eof, closed = "--- stdin closed (EOF) ---\n", "--- STDIN stream closed to target ---\n"
+	tests := []struct {
+		name   string
+		raw    bool
+		chunks []string
+		want   string
+	}{
+		{"lines", false, []string{"a\nb\n"}, "in:  a\nin:  b\n" + eof + closed},
+		{"line split across reads", false, []string{"he", "llo\n"}, "in:  hello\n" + eof + closed},
+		// The rest of a line is only logged once stdin has ended
+		{"partial line", false, []string{"a\nb"}, "in:  a\n" + eof + "in:  b␊(no-nl)\n" + closed},
+		// Raw chunks are logged as read, newline or not
+		{"raw", true, []string{"a\n", "b"}, "in:  a\nin:  b" + eof + closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, log := testLogger(&Proxy{})
+			sent := runStdin(t, logger, tt.raw, tt.chunks...)
+			if want := strings.Join(tt.chunks, ""); sent != want {
+				t.Errorf("child got %q, want %q", sent, want)
+			}
+			if log.String() != tt.want {
+				t.Errorf("log = %q, want %q", log.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardAndLogStdinJSONMarkers(t *testing.T) {
+	logger, log := testLogger(&Proxy{Format: "json"})
+	runStdin(t, logger, false, "hi\n")
+	want := `{"dir":"in","data":"hi\n"}
+{"event":"stdin_eof","text":"stdin closed (EOF)"}
+{"event":"stdin_closed","text":"STDIN stream closed to target"}
+`
+	if log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
+
+func TestForwardLinesMaxLine(t *testing.T) {
+	a, b := strings.Repeat("a", 98), strings.Repeat("b", 5000)
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"short", "abc\n", "out: abc\n"},
+		{"cut", strings.Repeat("a", 150) + "\n", "out: " + strings.Repeat("a", 100) + " …[truncated 50 bytes]\n"},
+		// The emoji straddling the limit is dropped whole, and nothing after
+		// the cut is logged even though later reads fit under the limit
+		{"cut in a character", a + "😀" + b + "\n", "out: " + a + " …[truncated 5004 bytes]\n"},
+		{"cut without newline", a + "😀" + b, "out: " + a + " …[truncated 5004 bytes]␊(no-nl)\n"},
+		{"next line", a + "😀" + b + "\nok\n", "out: " + a + " …[truncated 5004 bytes]\nout: ok\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A small buffer splits the line across many reads
+			logger, log := testLogger(&Proxy{MaxLine: 100, BufferSize: 16})
+			forwardLines(strings.NewReader(tt.input), io.Discard, logger, "out", "out: ")
+			if log.String() != tt.want {
+				t.Errorf("log = %q, want %q", log.String(), tt.want)
+			}
+		})
+	}
+	// With a limit below the first character's size nothing of the line is
+	// kept, but it is still marked and the lines after it are logged
+	t.Run("cut before the first character", func(t *testing.T) {
+		logger, log := testLogger(&Proxy{MaxLine: 1})
+		forwardLines(strings.NewReader("é\nabc\ndef\n"), io.Discard, logger, "out", "out: ")
+		if want := "out:  …[truncated 2 bytes]\nout: a …[truncated 2 bytes]\nout: d …[truncated 2 bytes]\n"; log.String() != want {
+			t.Errorf("log = %q, want %q", log.String(), want)
+		}
+	})
+}
+
+func TestForwardLinesCharacterAcrossReads(t *testing.T) {
+	// With a 16 byte buffer the emoji starts at byte 14 and spans two reads
+	input := strings.Repeat("a", 14) + "😀z\n"
+	logger, log := testLogger(&Proxy{BufferSize: 16})
+	forwardLines(strings.NewReader(input), io.Discard, logger, "out", "out: ")
+	if want := "out: " + input; log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
+
+func TestForwardAndLogStdinRawCharacterAcrossReads(t *testing.T) {
+	emoji := "😀"
+	logger, log := testLogger(&Proxy{})
+	sent := runStdin(t, logger, true, "ab"+emoji[:2], emoji[2:]+"cd")
+	if sent != "ab"+emoji+"cd" {
+		t.Errorf("child got %q", sent)
+	}
+	if !utf8.Valid(log.Bytes()) {
+		t.Errorf("log is not valid UTF-8: %q", log.String())
+	}
+	if want := "in:  abin:  " + emoji + "cd--- stdin closed (EOF) ---\n"; !strings.HasPrefix(log.String(), want) {
+		t.Errorf("log = %q, want it to start with %q", log.String(), want)
+	}
+}
+
+func TestForwardAndLogStdinRawCharacterAtEOF(t *testing.T) {
+	emoji := "😀"
+	logger, log := testLogger(&Proxy{})
+	runStdin(t, logger, true, "ab"+emoji[:2])
+	// The split character is logged as it is once stdin ends
+	want := "in:  ab--- stdin closed (EOF) ---\nin:  " + emoji[:2] + "--- STDIN stream closed to target ---\n"
+	if log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
+
+// dataEOFReader returns the last of its data together with io.EOF, as an
+// io.Reader may
+type dataEOFReader struct {
+	data []byte
+}
+
+func (r *dataEOFReader) Read(b []byte) (int, error) {
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestReadWithDataAndEOF(t *testing.T) {
+	t.Run("forwardLines", func(t *testing.T) {
+		logger, log := testLogger(&Proxy{})
+		var forwarded bytes.Buffer
+		if err := forwardLines(&dataEOFReader{[]byte("hello")}, &forwarded, logger, "out", "out: "); err != io.EOF {
+			t.Errorf("err = %v, want io.EOF", err)
+		}
+		if forwarded.String() != "hello" || log.String() != "out: hello␊(no-nl)\n" {
+			t.Errorf("forwarded %q, logged %q", forwarded.String(), log.String())
+		}
+	})
+	t.Run("forwardBlocks", func(t *testing.T) {
+		logger, log := testLogger(&Proxy{Binary: true})
+		var forwarded bytes.Buffer
+		if err := forwardBlocks(&dataEOFReader{[]byte("hello")}, &forwarded, logger, "out", "out: "); err != io.EOF {
+			t.Errorf("err = %v, want io.EOF", err)
+		}
+		if forwarded.String() != "hello" || !strings.HasPrefix(log.String(), "out: 5 bytes\n") {
+			t.Errorf("forwarded %q, logged %q", forwarded.String(), log.String())
+		}
+	})
+	t.Run("readChunks", func(t *testing.T) {
+		done := make(chan struct{})
+		defer close(done)
+		result, ok := <-readChunks(&dataEOFReader{[]byte("hello")}, 4096, done)
+		if !ok || string(result.data) != "hello" || result.err != io.EOF {
+			t.Errorf("first result = %q, %v, want \"hello\", io.EOF", result.data, result.err)
+		}
+	})
+	t.Run("stdin", func(t *testing.T) {
+		logger, log := testLogger(&Proxy{})
+		done := make(chan struct{})
+		defer close(done)
+		var stdin closeBuffer
+		var wg sync.WaitGroup
+		wg.Add(1)
+		forwardAndLogStdin(context.Background(), readChunks(&dataEOFReader{[]byte("hello")}, 4096, done), &stdin, logger, false, 0, false, nil, &wg)
+		if stdin.String() != "hello" {
+			t.Errorf("child got %q, want %q", stdin.String(), "hello")
+		}
+		if want := "--- stdin closed (EOF) ---\nin:  hello␊(no-nl)\n"; !strings.HasPrefix(log.String(), want) {
+			t.Errorf("log = %q, want it to start with %q", log.String(), want)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package stdiolog
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so it and its
+// descendants can be signalled together. Not for PTY mode, where the child
+// starts a session of its own, which already makes it a group leader and
+// would make joining a new group fail.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcess sends sig to cmd's process or, with group set, to every
+// process in its process group. Like Process.Signal it returns
+// os.ErrProcessDone if nothing is left to signal.
+func signalProcess(cmd *exec.Cmd, sig os.Signal, group bool) error {
+	s, ok := sig.(syscall.Signal)
+	if !group || !ok {
+		return cmd.Process.Signal(sig)
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, s); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package stdiolog
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing on Windows, which has no process groups to
+// signal
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcess sends sig to cmd's process, ignoring group
+func signalProcess(cmd *exec.Cmd, sig os.Signal, group bool) error {
+	return cmd.Process.Signal(sig)
+}
@@ -0,0 +1,73 @@
+package stdiolog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// heartbeat logs an idle marker whenever no data has crossed any stream for
+// interval, so a hung child can be told from a quiet one in the log
+type heartbeat struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time // when data last crossed a stream
+	timer    *time.Timer
+	stopped  bool // set by stop, so a firing timer is not rearmed
+	logger   *streamLog
+}
+
+// startHeartbeat starts timing idle periods, logging markers to logger
+func startHeartbeat(interval time.Duration, logger *streamLog) *heartbeat {
+	h := &heartbeat{interval: interval, last: time.Now(), logger: logger}
+	// Armed under mu, as idle reads the timer once it fires
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timer = time.AfterFunc(interval, h.idle)
+	return h
+}
+
+// active records that data crossed a stream. It is a no-op on a nil
+// heartbeat.
+func (h *heartbeat) active() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+	if !h.stopped {
+		h.timer.Reset(h.interval)
+	}
+}
+
+// idle logs the idle marker and rearms the timer, unless data arrived while
+// it fired or the heartbeat has stopped
+func (h *heartbeat) idle() {
+	h.mu.Lock()
+	if h.stopped {
+		h.mu.Unlock()
+		return
+	}
+	idleFor := time.Since(h.last)
+	h.timer.Reset(h.interval)
+	h.mu.Unlock()
+	if idleFor < h.interval {
+		return
+	}
+	if err := h.logger.marker("idle", fmt.Sprintf("idle (no activity for %ds)", int(idleFor.Round(time.Second).Seconds()))); err != nil {
+		log.Printf("Error writing to log file: %v", err)
+	}
+}
+
+// stop stops the heartbeat. It is a no-op on a nil heartbeat.
+func (h *heartbeat) stop() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = true
+	h.timer.Stop()
+}
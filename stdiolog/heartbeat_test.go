@@ -0,0 +1,24 @@
+package stdiolog
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatStop(t *testing.T) {
+	var log lockedBuffer
+	logger := (&Proxy{NoTimestamp: true}).newLogger(&log, &sync.Mutex{})
+	h := startHeartbeat(time.Millisecond, logger)
+	time.Sleep(20 * time.Millisecond)
+	h.stop()
+	time.Sleep(5 * time.Millisecond) // for a marker being written as it stopped
+	stopped := log.String()
+	if stopped == "" {
+		t.Fatal("no idle marker logged")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := log.String(); got != stopped {
+		t.Errorf("logged after stop: %q", got[len(stopped):])
+	}
+}
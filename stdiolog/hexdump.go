@@ -0,0 +1,35 @@
+package stdiolog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hexDump formats data like `hexdump -C`, numbering lines from offset so
+// that consecutive chunks of a stream continue the same address column
+func hexDump(data []byte, offset int64) string {
+	var sb strings.Builder
+	for start := 0; start < len(data); start += 16 {
+		line := data[start:min(start+16, len(data))]
+		fmt.Fprintf(&sb, "%08x  ", offset+int64(start))
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&sb, "%02x ", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+			if i == 7 {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(" |")
+		for _, b := range line {
+			if b < 32 || b > 126 {
+				b = '.'
+			}
+			sb.WriteByte(b)
+		}
+		sb.WriteString("|\n")
+	}
+	return sb.String()
+}
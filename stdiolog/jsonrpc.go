@@ -0,0 +1,303 @@
+package stdiolog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pendingTTL is how long a request is remembered while waiting for its
+// response, so a server that never answers doesn't grow the pending map
+const pendingTTL = 5 * time.Minute
+
+// defaultMaxPending is how many requests are remembered at most unless
+// Proxy.MaxPending is set
+const defaultMaxPending = 10000
+
+// maxRPCHeader bounds how many bytes are buffered while looking for the end
+// of a frame's headers before the data is treated as malformed
+const maxRPCHeader = 8192
+
+// maxRPCBody is the longest Content-Length accepted, so a corrupt header
+// can't make the framer buffer the stream without bound
+const maxRPCBody = 16 << 20
+
+// framer splits the chunks read off one stream into messages: rpcFramer
+// for Content-Length framing and length32Framer for length prefixes
+type framer interface {
+	// feed adds data read from the stream and returns the frames it completes
+	feed(data []byte) []rpcFrame
+	// rest returns and clears the bytes of an incomplete frame
+	rest() []byte
+	// name names the framing in markers
+	name() string
+}
+
+// rpcFramer reassembles Content-Length framed JSON-RPC messages, as used by
+// LSP and similar protocols, from the chunks read off one stream. After a
+// length over maxRPCBody it gives up parsing and passes the rest of the
+// stream on raw.
+type rpcFramer struct {
+	buf []byte
+	raw bool
+}
+
+// rpcFrame is either a complete message body or, if malformed is set, bytes
+// that could not be parsed as a frame. An opaque body need not be JSON, and
+// is hex-dumped if it is not. raw data comes from a stream no longer parsed
+// after a malformed frame, and is logged as is.
+type rpcFrame struct {
+	body      []byte
+	malformed bool
+	opaque    bool
+	raw       bool
+}
+
+// feed adds data read from the stream and returns the frames it completes
+func (f *rpcFramer) feed(data []byte) []rpcFrame {
+	if f.raw {
+		return []rpcFrame{{body: bytes.Clone(data), raw: true}}
+	}
+	f.buf = append(f.buf, data...)
+	var frames []rpcFrame
+	for len(f.buf) > 0 {
+		headerEnd := bytes.Index(f.buf, []byte("\r\n\r\n"))
+		if headerEnd < 0 {
+			if len(f.buf) > maxRPCHeader {
+				frames = append(frames, f.discard(len(f.buf)))
+			}
+			break
+		}
+		length, ok := contentLength(f.buf[:headerEnd])
+		if !ok {
+			frames = append(frames, f.discard(headerEnd+4))
+			continue
+		}
+		if length > maxRPCBody {
+			frames = append(frames, rpcFrame{body: f.rest(), malformed: true})
+			f.raw = true
+			break
+		}
+		end := headerEnd + 4 + length
+		if len(f.buf) < end {
+			break // wait for the rest of the body
+		}
+		body := append([]byte(nil), f.buf[headerEnd+4:end]...)
+		f.buf = f.buf[end:]
+		frames = append(frames, rpcFrame{body: body})
+	}
+	return frames
+}
+
+func (f *rpcFramer) rest() []byte {
+	rest := f.buf
+	f.buf = nil
+	return rest
+}
+
+func (f *rpcFramer) name() string { return "JSON-RPC" }
+
+// discard drops the first n buffered bytes, returning them as a malformed frame
+func (f *rpcFramer) discard(n int) rpcFrame {
+	frame := rpcFrame{body: append([]byte(nil), f.buf[:n]...), malformed: true}
+	f.buf = f.buf[n:]
+	return frame
+}
+
+// contentLength returns the Content-Length value of a frame's header block
+func contentLength(header []byte) (int, bool) {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			return n, err == nil && n >= 0
+		}
+	}
+	return 0, false
+}
+
+// rpcEnvelope holds the fields used to correlate requests with responses
+// and to summarise messages in the index
+type rpcEnvelope struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// compactID returns the message id as compact JSON, or "" if it has none
+func (m *rpcEnvelope) compactID() string {
+	if len(m.ID) == 0 || string(m.ID) == "null" {
+		return ""
+	}
+	var id bytes.Buffer
+	if json.Compact(&id, m.ID) != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// pendingRequests records when each request sent to the child was seen, by
+// id, until the matching response arrives or the entry expires. At most max
+// requests are remembered, so a child that never responds can't grow it
+// without bound.
+type pendingRequests struct {
+	mu        sync.Mutex
+	started   map[string]time.Time
+	max       int
+	lastSweep time.Time
+}
+
+// start records that the request with id was sent at now, first evicting
+// requests older than pendingTTL and, if max requests are still pending, the
+// oldest quarter of them
+func (p *pendingRequests) start(id string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	full := len(p.started) >= p.max
+	if full || now.Sub(p.lastSweep) >= pendingTTL {
+		for pendingID, t := range p.started {
+			if now.Sub(t) >= pendingTTL {
+				delete(p.started, pendingID)
+			}
+		}
+		p.lastSweep = now
+	}
+	if len(p.started) >= p.max {
+		// Evicting a quarter at a time keeps the sort off the hot path
+		times := slices.SortedFunc(maps.Values(p.started), time.Time.Compare)
+		cutoff := times[len(times)/4]
+		for pendingID, t := range p.started {
+			if !t.After(cutoff) {
+				delete(p.started, pendingID)
+			}
+		}
+	}
+	p.started[id] = now
+}
+
+// finish returns how long ago the request with id was sent, forgetting it
+func (p *pendingRequests) finish(id string, now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.started[id]
+	if !ok {
+		return 0, false
+	}
+	delete(p.started, id)
+	return now.Sub(t), true
+}
+
+// latency tracks a request read from stdin, or returns the latency suffix for
+// a response read from stdout
+func (l *streamLog) latency(dir string, msg *rpcEnvelope) string {
+	id := msg.compactID()
+	if id == "" {
+		return ""
+	}
+	now := time.Now()
+	switch {
+	case dir == "in" && msg.Method != "":
+		l.pending.start(id, now)
+	case dir == "out" && msg.Method == "":
+		if elapsed, ok := l.pending.finish(id, now); ok {
+			return fmt.Sprintf(" (latency %.1fms)", float64(elapsed.Microseconds())/1000)
+		}
+	}
+	return ""
+}
+
+// frames logs the JSON-RPC messages completed by data, each pretty-printed
+// with its index in the conversation and, for responses, the time since the
+// request with the same id was read from stdin. Opaque bodies that are not
+// JSON are hex-dumped with their index. Anything else that is not a valid
+// frame or JSON body is logged raw after a warning marker.
+func (l *streamLog) frames(dir, label string, data []byte) {
+	for _, frame := range l.rpc.feed(data) {
+		if frame.raw {
+			l.entry(dir, label, frame.body, true)
+			continue
+		}
+		var pretty bytes.Buffer
+		if !frame.malformed && json.Indent(&pretty, frame.body, "", "  ") == nil {
+			n := l.rpcIndex.Add(1)
+			var msg rpcEnvelope
+			json.Unmarshal(frame.body, &msg) // a valid non-object body leaves it empty
+			l.entry(dir, label, fmt.Appendf(nil, "#%d %s%s", n, pretty.Bytes(), l.latency(dir, &msg)), true)
+			if l.rpcSummary != nil {
+				l.summarise(n, dir, &msg)
+			}
+			continue
+		}
+		if !frame.malformed && frame.opaque {
+			n := l.rpcIndex.Add(1)
+			l.entry(dir, label, fmt.Appendf(nil, "#%d %d bytes\n%s", n, len(frame.body), hexDump(frame.body, 0)), true)
+			if l.rpcSummary != nil {
+				l.summarise(n, dir, &rpcEnvelope{})
+			}
+			continue
+		}
+		l.marker("malformed_frame", "malformed "+l.rpc.name()+" frame on "+dir+", logging raw")
+		l.entry(dir, label, frame.body, true)
+	}
+}
+
+// summarise writes the index line of message n, "#N <dir> method=<m>
+// id=<id>" for requests and notifications or "#N <dir> result id=<id>" and
+// "#N <dir> error id=<id>" for responses, to rpcSummary
+func (l *streamLog) summarise(n int64, dir string, msg *rpcEnvelope) {
+	line := fmt.Sprintf("#%d %s", n, dir)
+	switch {
+	case msg.Method != "":
+		line += " method=" + msg.Method
+	case len(msg.Error) > 0 && string(msg.Error) != "null":
+		line += " error"
+	case len(msg.Result) > 0:
+		line += " result"
+	}
+	if id := msg.compactID(); id != "" {
+		line += " id=" + id
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := io.WriteString(l.rpcSummary, line+"\n"); err != nil {
+		log.Printf("Error writing to JSON-RPC index: %v", err)
+		return
+	}
+	if err := syncWriter(l.rpcSummary); err != nil {
+		log.Printf("Error writing to JSON-RPC index: %v", err)
+	}
+}
+
+// flushFrames logs any incomplete frame left when the stream closes
+func (l *streamLog) flushFrames(dir, label string) {
+	rest := l.rpc.rest()
+	if len(rest) == 0 {
+		return
+	}
+	l.marker("incomplete_frame", "incomplete "+l.rpc.name()+" frame on "+dir+", logging raw")
+	l.entry(dir, label, rest, true)
+}
+
+// newRPCLogs gives each logger its own framer, made by newFramer, and a
+// message counter, pending request map, remembering at most maxPending
+// requests, and index writer, if any, shared by all of them
+func newRPCLogs(newFramer func() framer, maxPending int, summary io.Writer, logs ...*streamLog) {
+	index := new(atomic.Int64)
+	pending := &pendingRequests{started: map[string]time.Time{}, max: maxPending}
+	for _, l := range logs {
+		l.rpc = newFramer()
+		l.rpcIndex = index
+		l.pending = pending
+		l.rpcSummary = summary
+	}
+}
@@ -0,0 +1,102 @@
+package stdiolog
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frame returns body with a Content-Length header
+func frame(body string) string {
+	return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func TestRPCFramer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []rpcFrame
+		rest   string
+	}{
+		{"frame", []string{frame(`{"id":1}`)}, []rpcFrame{{body: []byte(`{"id":1}`)}}, ""},
+		{"split frame", []string{"Content-Len", "gth: 8\r\n\r\n{\"id\"", ":1}"}, []rpcFrame{{body: []byte(`{"id":1}`)}}, ""},
+		{"two frames", []string{frame(`1`) + frame(`2`)}, []rpcFrame{{body: []byte(`1`)}, {body: []byte(`2`)}}, ""},
+		{"incomplete", []string{"Content-Length: 8\r\n\r\n{"}, nil, "Content-Length: 8\r\n\r\n{"},
+		{"no length", []string{"X: 1\r\n\r\n" + frame(`1`)}, []rpcFrame{{body: []byte("X: 1\r\n\r\n"), malformed: true}, {body: []byte(`1`)}}, ""},
+		{"length too long", []string{"Content-Length: 16777217\r\n\r\nabc", "def"}, []rpcFrame{
+			{body: []byte("Content-Length: 16777217\r\n\r\nabc"), malformed: true},
+			{body: []byte("def"), raw: true},
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &rpcFramer{}
+			var got []rpcFrame
+			for _, chunk := range tt.chunks {
+				got = append(got, f.feed([]byte(chunk))...)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d frames %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if string(got[i].body) != string(tt.want[i].body) || got[i].malformed != tt.want[i].malformed || got[i].raw != tt.want[i].raw {
+					t.Errorf("frame %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+			if rest := string(f.rest()); rest != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestPendingRequestsBounded(t *testing.T) {
+	const max = 1000
+	p := &pendingRequests{started: map[string]time.Time{}, max: max}
+	now := time.Now()
+	for i := range 100000 {
+		p.start(strconv.Itoa(i), now.Add(time.Duration(i)*time.Millisecond))
+		if len(p.started) > max {
+			t.Fatalf("%d requests pending after %d, want at most %d", len(p.started), i+1, max)
+		}
+	}
+	// The newest request is still remembered, the oldest long evicted
+	if _, ok := p.finish("99999", now.Add(100*time.Second)); !ok {
+		t.Error("newest request was evicted")
+	}
+	if _, ok := p.finish("0", now.Add(100*time.Second)); ok {
+		t.Error("oldest request is still pending")
+	}
+}
+
+func TestPendingRequestsExpire(t *testing.T) {
+	p := &pendingRequests{started: map[string]time.Time{}, max: 1000}
+	now := time.Now()
+	p.start("old", now)
+	p.start("new", now.Add(pendingTTL))
+	if _, ok := p.finish("old", now.Add(pendingTTL)); ok {
+		t.Error("request older than pendingTTL is still pending")
+	}
+}
+
+func TestRPCFloodStaysBounded(t *testing.T) {
+	// 100k requests read from stdin that are never answered
+	in := (&Proxy{}).newLogger(io.Discard, &sync.Mutex{})
+	out := (&Proxy{}).newLogger(io.Discard, &sync.Mutex{})
+	newRPCLogs(func() framer { return &rpcFramer{} }, 1000, nil, in, out)
+	for i := range 100000 {
+		in.frames("in", "in:  ", []byte(frame(fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"ping"}`, i))))
+	}
+	if n := len(in.pending.started); n > 1000 {
+		t.Errorf("%d requests pending, want at most 1000", n)
+	}
+	if n := len(in.rpc.(*rpcFramer).buf); n != 0 {
+		t.Errorf("framer holds %d bytes, want 0", n)
+	}
+	if n := in.rpcIndex.Load(); n != 100000 {
+		t.Errorf("logged %d messages, want 100000", n)
+	}
+}
@@ -0,0 +1,51 @@
+package stdiolog
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// maxFrame32 is the longest length32 frame accepted; a longer length prefix
+// is taken as a sign that the stream is not length32 framed after all
+const maxFrame32 = 16 << 20
+
+// length32Framer reassembles frames made of a 4-byte big-endian length and
+// that many bytes of payload, as in gRPC-style protocols, from the chunks
+// read off one stream. After a malformed prefix it gives up parsing and
+// passes the rest of the stream on raw.
+type length32Framer struct {
+	buf []byte
+	raw bool
+}
+
+// feed adds data read from the stream and returns the frames it completes
+func (f *length32Framer) feed(data []byte) []rpcFrame {
+	if f.raw {
+		return []rpcFrame{{body: bytes.Clone(data), raw: true}}
+	}
+	f.buf = append(f.buf, data...)
+	var frames []rpcFrame
+	for len(f.buf) >= 4 {
+		length := binary.BigEndian.Uint32(f.buf)
+		if length > maxFrame32 {
+			frames = append(frames, rpcFrame{body: f.rest(), malformed: true})
+			f.raw = true
+			break
+		}
+		end := 4 + int(length)
+		if len(f.buf) < end {
+			break // wait for the rest of the payload
+		}
+		frames = append(frames, rpcFrame{body: bytes.Clone(f.buf[4:end]), opaque: true})
+		f.buf = f.buf[end:]
+	}
+	return frames
+}
+
+func (f *length32Framer) rest() []byte {
+	rest := f.buf
+	f.buf = nil
+	return rest
+}
+
+func (f *length32Framer) name() string { return "length32" }
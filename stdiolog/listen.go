@@ -0,0 +1,82 @@
+package stdiolog
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// stdinConn is the proxy's stdin when it is taken from a TCP connection,
+// per Proxy.StdinListen. The first read accepts one connection and closes
+// the listener, so the child runs while the proxy waits for it. With
+// Proxy.StdoutToConn the child's stdout is also written back over the
+// connection once it is open.
+type stdinConn struct {
+	ln     net.Listener
+	logger *streamLog
+	accept sync.Once
+	mu     sync.Mutex
+	conn   net.Conn // set once accepted
+	err    error    // why accepting failed
+	failed atomic.Bool
+}
+
+// listenStdin listens on the TCP address addr, e.g. ":9000", for the
+// connection that feeds the child's stdin
+func listenStdin(addr string, logger *streamLog) (*stdinConn, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &stdinConn{ln: ln, logger: logger}, nil
+}
+
+// Read reads from the connection, accepting it first if need be. The end
+// of the connection, or failing to accept one, ends stdin.
+func (s *stdinConn) Read(b []byte) (int, error) {
+	s.accept.Do(func() {
+		conn, err := s.ln.Accept()
+		s.ln.Close()
+		s.mu.Lock()
+		s.conn, s.err = conn, err
+		s.mu.Unlock()
+		if err == nil {
+			s.logger.marker("stdin_connected", "stdin connection from "+conn.RemoteAddr().String())
+		}
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+	n, err := s.conn.Read(b)
+	if err != nil {
+		s.logger.marker("stdin_disconnected", "stdin connection from "+s.conn.RemoteAddr().String()+" closed")
+	}
+	return n, err
+}
+
+// Write sends the child's stdout back over the connection. Output before
+// the connection is accepted, or after sending fails, is not sent; the
+// proxy's own stdout still gets all of it, so Write never fails.
+func (s *stdinConn) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil || s.failed.Load() {
+		return len(b), nil
+	}
+	if _, err := conn.Write(b); err != nil && !s.failed.Swap(true) {
+		s.logger.marker("stdin_conn_write_error", "sending stdout to stdin connection failed: "+err.Error())
+	}
+	return len(b), nil
+}
+
+// Close stops listening and closes any accepted connection
+func (s *stdinConn) Close() error {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
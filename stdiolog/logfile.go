@@ -0,0 +1,348 @@
+package stdiolog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// LogFile is an on-disk log that can be shared by all forwarders. It
+// serialises writes and, when maxSize is set, rolls over to a new numbered
+// file once that many bytes have been written to the current one.
+type LogFile struct {
+	mu      sync.Mutex
+	path    string
+	codec   string // "gzip", "zstd" or "" for none
+	osync   bool
+	perm    os.FileMode
+	maxSize int64
+	index   int
+	size    int64
+	file    *os.File
+	comp    compressor
+	stop    chan struct{} // closed to stop RotateEvery
+	stopped chan struct{} // closed once RotateEvery has stopped
+
+	manifest string    // path of the manifest, if one is kept
+	segments []segment // the files of the log so far, the last one current
+}
+
+// segment is one file of a rotated log as listed in its manifest. End is
+// unset while the file is still being written.
+type segment struct {
+	Path  string     `json:"path"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"`
+	Bytes int64      `json:"bytes"`
+}
+
+// compressor is a compressing writer over the log file. Flush ends a
+// complete block, so a crash leaves a truncated but readable stream, and
+// Close writes the trailer.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// CompressExt returns the file extension of the named codec: ".gz" for
+// gzip, ".zst" for zstd and "" for none
+func CompressExt(codec string) string {
+	switch codec {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+// OpenLogFile opens the first log file at path. With compress set to "gzip"
+// or "zstd" the log is compressed with that codec; each Sync flushes a
+// complete block, so a crash leaves a truncated but readable stream. An
+// empty compress, or "none", leaves it uncompressed. With osync set files
+// are opened with O_SYNC, so every write reaches the disk before it
+// returns and Sync no longer fsyncs. Which is cheaper depends on the
+// filesystem: O_SYNC pays on every write, fsync once per entry, so O_SYNC
+// tends to win when each entry is a single write, as it is without
+// compression. New files, including rotated ones, are created with perm
+// before the umask.
+func OpenLogFile(path string, compress string, osync bool, perm os.FileMode, maxSize int64) (*LogFile, error) {
+	switch compress {
+	case "", "none":
+		compress = ""
+	case "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("invalid compression %q: must be none, gzip or zstd", compress)
+	}
+	l := &LogFile{path: path, codec: compress, osync: osync, perm: perm, maxSize: maxSize}
+	file, comp, err := l.open(path)
+	if err != nil {
+		return nil, err
+	}
+	l.file, l.comp = file, comp
+	l.startSegment(path)
+	return l, nil
+}
+
+// KeepManifest maintains a JSON manifest of the log's files at path,
+// {"segments": [{"path", "start", "end", "bytes"}, ...]}, with paths
+// relative to the manifest's directory and bytes uncompressed. It is
+// rewritten on each rotation and on Close.
+func (l *LogFile) KeepManifest(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.manifest = path
+	return l.writeManifest()
+}
+
+// startSegment records that the file at path is now written to
+func (l *LogFile) startSegment(path string) {
+	l.segments = append(l.segments, segment{Path: path, Start: time.Now()})
+}
+
+// endSegment records that the current file is finished. Callers must hold
+// l.mu.
+func (l *LogFile) endSegment() {
+	now := time.Now()
+	current := &l.segments[len(l.segments)-1]
+	current.End, current.Bytes = &now, l.size
+}
+
+// writeManifest replaces the manifest, if one is kept, with the segments so
+// far. It is written to a temporary file first, so readers never see it
+// half written. Callers must hold l.mu.
+func (l *LogFile) writeManifest() error {
+	if l.manifest == "" {
+		return nil
+	}
+	dir := filepath.Dir(l.manifest)
+	segments := make([]segment, len(l.segments))
+	for i, seg := range l.segments {
+		if rel, err := filepath.Rel(dir, seg.Path); err == nil {
+			seg.Path = rel
+		}
+		segments[i] = seg
+	}
+	data, err := json.MarshalIndent(struct {
+		Segments []segment `json:"segments"`
+	}{segments}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.manifest + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), l.perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.manifest)
+}
+
+// open opens path in append mode, wrapping it in a compressor if needed
+func (l *LogFile) open(path string) (*os.File, compressor, error) {
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if l.osync {
+		flags |= os.O_SYNC
+	}
+	file, err := os.OpenFile(path, flags, l.perm)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch l.codec {
+	case "gzip":
+		return file, gzip.NewWriter(file), nil
+	case "zstd":
+		enc, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return file, enc, nil
+	}
+	return file, nil, nil
+}
+
+// segmentPath returns the path of the nth rotated file, e.g.
+// stdio-<timestamp>.log becomes stdio-<timestamp>.1.log
+func (l *LogFile) segmentPath(n int) string {
+	return WithInfix(l.path, strconv.Itoa(n))
+}
+
+// WithInfix inserts infix before the file extension of path, keeping any
+// trailing .gz or .zst last, e.g. stdio-<timestamp>.log.gz becomes
+// stdio-<timestamp>.<infix>.log.gz
+func WithInfix(path, infix string) string {
+	base, compExt := path, ""
+	for _, e := range []string{".gz", ".zst"} {
+		if strings.HasSuffix(base, e) {
+			base, compExt = strings.TrimSuffix(base, e), e
+			break
+		}
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + infix + ext + compExt
+}
+
+func (l *LogFile) writer() io.Writer {
+	if l.comp != nil {
+		return l.comp
+	}
+	return l.file
+}
+
+// Write appends p to the current file. Rotation only happens between writes,
+// so a single write is never split across two files.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, err := l.writer().Write(p)
+	l.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		if rotErr := l.rotate(); rotErr != nil {
+			return n, fmt.Errorf("rotating log: %w", rotErr)
+		}
+	}
+	return n, nil
+}
+
+// rotate opens the next numbered file before closing the current one, so a
+// failed open leaves logging on the old file. Callers must hold l.mu.
+func (l *LogFile) rotate() error {
+	file, comp, err := l.open(l.segmentPath(l.index + 1))
+	if err != nil {
+		return err
+	}
+	closeErr := l.closeCurrent()
+	l.endSegment()
+	l.index++
+	l.size = 0
+	l.file, l.comp = file, comp
+	l.startSegment(l.segmentPath(l.index))
+	if err := l.writeManifest(); err != nil {
+		log.Printf("Error writing log manifest: %v", err)
+	}
+	return closeErr
+}
+
+// Reopen closes the current file and opens its path again, creating it if
+// it has been moved away, so the log follows external rotation such as
+// logrotate's rather than writing on to a renamed or deleted file. The old
+// file is kept if the path can't be opened. A compressed log starts a new
+// stream, and size rotation counts from the reopen.
+func (l *LogFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path := l.path
+	if l.index > 0 {
+		path = l.segmentPath(l.index)
+	}
+	file, comp, err := l.open(path)
+	if err != nil {
+		return err
+	}
+	closeErr := l.closeCurrent()
+	l.size = 0
+	l.file, l.comp = file, comp
+	return closeErr
+}
+
+// RotateEvery switches to a new file at path(now) every interval until the
+// log is closed. Size rotation then numbers files after the new path. Like
+// size rotation it takes the write lock, so it only happens between writes.
+func (l *LogFile) RotateEvery(interval time.Duration, path func(now time.Time) string) {
+	l.stop, l.stopped = make(chan struct{}), make(chan struct{})
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer close(l.stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := l.rotateTo(path(now)); err != nil {
+					log.Printf("Error rotating log file: %v", err)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// rotateTo switches to a new file at path, keeping the old one if it can't
+// be opened
+func (l *LogFile) rotateTo(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, comp, err := l.open(path)
+	if err != nil {
+		return err
+	}
+	closeErr := l.closeCurrent()
+	l.endSegment()
+	l.path, l.index, l.size = path, 0, 0
+	l.file, l.comp = file, comp
+	l.startSegment(path)
+	if err := l.writeManifest(); err != nil {
+		log.Printf("Error writing log manifest: %v", err)
+	}
+	return closeErr
+}
+
+// closeCurrent writes any compression trailer and closes the current file
+func (l *LogFile) closeCurrent() error {
+	var compErr error
+	if l.comp != nil {
+		compErr = l.comp.Close()
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	return compErr
+}
+
+// Sync flushes buffered data and commits the current file to disk, which
+// with O_SYNC the flush alone does
+func (l *LogFile) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.comp != nil {
+		if err := l.comp.Flush(); err != nil {
+			return err
+		}
+	}
+	if l.osync {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// Close stops any time rotation and closes the current file, finishing
+// the manifest if one is kept
+func (l *LogFile) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.stopped
+		l.stop = nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	closeErr := l.closeCurrent()
+	l.endSegment()
+	if err := l.writeManifest(); err != nil {
+		log.Printf("Error writing log manifest: %v", err)
+	}
+	return closeErr
+}
@@ -0,0 +1,35 @@
+package stdiolog
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkLogFile compares syncing after every entry with O_SYNC, writing
+// and syncing one entry at a time as streamLog does
+func BenchmarkLogFile(b *testing.B) {
+	entry := []byte("2024-01-02T03:04:05.000Z out: " + strings.Repeat("x", 80) + "\n")
+	for _, osync := range []bool{false, true} {
+		name := "fsync"
+		if osync {
+			name = "osync"
+		}
+		b.Run(name, func(b *testing.B) {
+			logFile, err := OpenLogFile(filepath.Join(b.TempDir(), "bench.log"), "none", osync, 0644, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer logFile.Close()
+			b.SetBytes(int64(len(entry)))
+			for b.Loop() {
+				if _, err := logFile.Write(entry); err != nil {
+					b.Fatal(err)
+				}
+				if err := logFile.Sync(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
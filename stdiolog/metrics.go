@@ -0,0 +1,46 @@
+package stdiolog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serveMetrics serves the stream counters as Prometheus text metrics on addr
+// until the returned stop function is called. It fails if addr can't be
+// listened on.
+func serveMetrics(addr string, stats *streamStats) (stop func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range []struct {
+			name, help string
+			value      int64
+		}{
+			{"stdio_logger_bytes_in_total", "Bytes forwarded to the child's stdin.", stats.in.Load()},
+			{"stdio_logger_bytes_out_total", "Bytes forwarded from the child's stdout.", stats.out.Load()},
+			{"stdio_logger_bytes_err_total", "Bytes forwarded from the child's stderr.", stats.err.Load()},
+			{"stdio_logger_restarts_total", "Times the child was restarted.", stats.restarts.Load()},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("Error serving metrics: %v", err)
+		}
+	}()
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
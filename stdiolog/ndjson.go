@@ -0,0 +1,24 @@
+package stdiolog
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// maxNDJSONLine caps the logged part of a line in NDJSON mode unless
+// Proxy.MaxLine is set, so one huge message can't exhaust memory. Longer
+// lines are still forwarded whole but logged truncated and raw.
+const maxNDJSONLine = 16 << 20
+
+// ndjsonLine returns line pretty-printed if the logger is in NDJSON mode and
+// it is valid JSON, and line itself otherwise
+func (l *streamLog) ndjsonLine(line []byte) []byte {
+	if !l.ndjson {
+		return line
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, line, "", "  ") != nil {
+		return line
+	}
+	return pretty.Bytes()
+}
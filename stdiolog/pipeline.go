@@ -0,0 +1,86 @@
+package stdiolog
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// pipelineStage is a started pipeline stage after the first
+type pipelineStage struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	stderr *os.File
+}
+
+// startStage starts one later pipeline stage with pipes for all its
+// streams. The caller closes its stdout and stderr once they are drained.
+func (p *Proxy) startStage(ctx context.Context, args []string) (*pipelineStage, error) {
+	stage := &pipelineStage{cmd: p.commandFor(ctx, args[0], args[1:])}
+	var err error
+	if stage.stdin, err = stage.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	var started func()
+	if stage.stdout, stage.stderr, started, err = outputPipes(stage.cmd); err != nil {
+		return nil, err
+	}
+	err = stage.cmd.Start()
+	started()
+	if err != nil {
+		stage.stdout.Close()
+		stage.stderr.Close()
+		return nil, err
+	}
+	return stage, nil
+}
+
+// outputPipes connects cmd's stdout and stderr to pipes the proxy reads.
+// Unlike with StdoutPipe and StderrPipe, Wait leaves the read ends open, so
+// the child can be waited for while its output is still being drained; the
+// caller closes them. started closes the child's ends once it has started,
+// or failed to.
+func outputPipes(cmd *exec.Cmd) (stdout, stderr *os.File, started func(), err error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, nil, nil, err
+	}
+	cmd.Stdout, cmd.Stderr = outW, errW
+	return outR, errR, func() {
+		outW.Close()
+		errW.Close()
+	}, nil
+}
+
+// stagesCmds returns the processes of the stages
+func stagesCmds(stages []*pipelineStage) []*exec.Cmd {
+	var cmds []*exec.Cmd
+	for _, stage := range stages {
+		cmds = append(cmds, stage.cmd)
+	}
+	return cmds
+}
+
+// pipeWriter feeds a stage's output to the next stage. If the next stage
+// stops reading, it closes src so the writing stage gets SIGPIPE, as it
+// would in a shell pipeline, rather than running on unread.
+type pipeWriter struct {
+	w   io.Writer
+	src io.Closer
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if err != nil {
+		p.src.Close()
+	}
+	return n, err
+}
@@ -0,0 +1,1204 @@
+// Package stdiolog runs a command while logging all STDIN/STDOUT/STDERR
+// traffic and passing it through verbatim.
+package stdiolog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// execTimeoutCode is the exit code when ExecTimeout stops the child
+const execTimeoutCode = 124
+
+// DefaultTimeFormat is the layout used for log timestamps unless
+// Proxy.TimeFormat is set
+const DefaultTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Proxy wraps a command, forwarding its stdio and logging every chunk
+type Proxy struct {
+	Command string
+	Args    []string
+	// NoShell runs Command directly instead of through sh -c or cmd.exe /C
+	NoShell bool
+	// Shell selects how Command is wrapped: "sh" (sh -c), "cmd" (cmd.exe /C),
+	// "powershell" (powershell.exe -Command, or pwsh off Windows) or "none".
+	// If empty it is cmd on Windows and sh elsewhere, or none with NoShell.
+	Shell string
+	// ShellPath, when set, is the interpreter binary run for Shell instead of
+	// sh, cmd.exe, powershell.exe or pwsh looked up in PATH, e.g.
+	// /bin/busybox-sh. Run fails before starting anything if it can't be
+	// found.
+	ShellPath string
+	// Pipeline lists further commands, each with its args, that Command's
+	// stdout is piped through in turn, like "Command | Pipeline[0] | ...".
+	// Each is wrapped like Command. Output passed between stages i and i+1 is
+	// logged as "out<i>", stderr of stage i as "err<i>", counting Command as
+	// stage 1; the last stage's stdout is logged as "out". The exit code is
+	// that of the last stage. Not supported with PTY.
+	Pipeline [][]string
+	// Dir is the child's working directory, the proxy's own if empty
+	Dir string
+	// Env, if non-nil, is the child's environment in KEY=VALUE form,
+	// replacing the proxy's own as for exec.Cmd.Env
+	Env []string
+	// PTY runs the child on a pseudo-terminal so interactive programs behave
+	// as if attached to a terminal. Its combined output is logged as stdout.
+	// Not supported on Windows.
+	PTY bool
+
+	// Log receives the log entries. StdoutLog and StderrLog, when set, receive
+	// the stdout and stderr entries instead, with Log keeping stdin entries.
+	// A writer with a Sync method is synced after every entry, unless
+	// FlushInterval is set.
+	Log       io.Writer
+	StdoutLog io.Writer
+	StderrLog io.Writer
+	// Tee lists secondary destinations that receive a copy of every log
+	// write. Their errors are reported once and otherwise ignored, so the
+	// primary logs keep working if every tee fails.
+	Tee []io.Writer
+	// AsyncLog, when non-zero, writes the log from a separate goroutine
+	// through a queue of this many entries, so a slow log never holds up
+	// forwarding. When the queue is full the oldest entries are dropped and
+	// a "--- N log entries dropped ---" marker takes their place.
+	AsyncLog int
+	// RingSize, when non-zero, keeps the most recent log entries, up to this
+	// many bytes, in memory and writes them to the logs only if the child
+	// exits with a non-zero status, so a healthy run does no log I/O. Older
+	// entries are counted in a marker before the dump.
+	RingSize int
+	// Trigger, when set, holds back the logs until data logged on any
+	// stream matches it, from then on logging in full after a "--- trigger
+	// matched, logging started ---" marker. Earlier entries are dropped, or
+	// with TriggerContext the most recent ones, up to that many bytes, are
+	// written out before the marker.
+	Trigger        *regexp.Regexp
+	TriggerContext int
+	// Syslog, when set, also receives every log entry; see DialSyslog
+	Syslog *Syslog
+	// FlushInterval, when non-zero, buffers log entries and flushes them on
+	// this interval and once on exit instead of after every entry
+	FlushInterval time.Duration
+
+	// Prefixes, when set, replaces the "out: " and "err: " labels of stdout
+	// and stderr entries in the text log
+	Prefixes *Prefixes
+	// AlignPrefixes pads the labels of all streams, including those of
+	// pipeline stages, to the width of the longest, so the data of text
+	// entries lines up. Empty labels stay empty.
+	AlignPrefixes bool
+
+	// Dirs lists the streams whose data is logged, any of "in", "out" and
+	// "err"; all of them if nil. The others are still forwarded, and proxy
+	// markers are always logged.
+	Dirs []string
+
+	// Format is "text" (the default), "json" or "csv". CSV logs start with
+	// a timestamp,direction,bytes,data header record; markers are records
+	// with direction "marker".
+	Format string
+	// TimeFormat is the Go layout for timestamps, DefaultTimeFormat if empty
+	TimeFormat string
+	// Local uses local time for timestamps instead of UTC
+	Local bool
+	// Clock returns the time recorded in timestamps and the header, time.Now
+	// if nil. Stubbing it makes logs reproducible, e.g. for golden tests;
+	// durations such as latencies are still measured with the real clock.
+	Clock func() time.Time
+	// NoTimestamp leaves timestamps out of entries and markers, so the logs
+	// of two runs can be diffed
+	NoTimestamp bool
+	// NoMarkers leaves "--- ... ---" markers, header included, out of the
+	// log, so it holds only logged data, e.g. for machine parsing. In json
+	// format markers are otherwise {"event", "text"} records.
+	NoMarkers bool
+	// Seq numbers every log line, across all streams, in the order they
+	// reach the log. Text lines start with the number, before the
+	// timestamp; JSON entries get a seq field. CSV records have no column
+	// for it, so it can't be combined with csv format.
+	Seq bool
+	// MaxTotal, when positive, caps the bytes written to the log across all
+	// streams, header included. Once it is reached "--- log budget
+	// exhausted, further output not logged ---" is logged and nothing more;
+	// data is still forwarded.
+	MaxTotal int64
+	// Turns logs a "--- turn: in->out ---" marker whenever an entry's
+	// direction differs from the previous entry's, to make the turn-taking
+	// of request/response conversations stand out
+	Turns bool
+	// Binary logs data as a hex dump and reads stdout/stderr in fixed-size
+	// blocks instead of lines, for streams that are not text
+	Binary bool
+	// Base64 logs each entry's data base64-encoded, so every entry is a
+	// single line free of control characters. With Binary it replaces the
+	// hex dump. Forwarded data is never altered.
+	Base64 bool
+	// JSONRPC parses Content-Length framed JSON-RPC messages on stdin and
+	// stdout, as used by LSP, and logs each one pretty-printed with its index.
+	// Responses are logged with the latency since the request with their id.
+	JSONRPC bool
+	// MaxPending caps how many requests awaiting a response JSONRPC keeps
+	// for latency, 10000 if zero. Requests are forgotten after 5 minutes, and
+	// when the cap is reached the oldest quarter is evicted early; their
+	// responses are then logged without latency.
+	MaxPending int
+	// Framing, when set to "length32", parses stdin and stdout as frames of
+	// a 4-byte big-endian length followed by that many bytes of payload, as
+	// in gRPC-style protocols, and logs each payload with its index like
+	// JSONRPC: pretty-printed if it is JSON, hex-dumped otherwise. A length
+	// over 16MiB is logged as malformed and the rest of the stream raw.
+	// Forwarded data is never altered. It can't be combined with JSONRPC.
+	Framing string
+	// JSONRPCIndex, when set with JSONRPC or Framing, receives one line per
+	// message, "#N <dir> method=<m> id=<id>" or, for responses, "#N <dir>
+	// result id=<id>" or "error", numbered like the log, to scan a
+	// conversation without its payloads
+	JSONRPCIndex io.Writer
+	// NDJSON logs stdin and stdout/stderr lines that are valid JSON, as in
+	// newline-delimited JSON protocols, pretty-printed, and others raw.
+	// Forwarded data is never altered. Unless MaxLine is set, logged
+	// stdout/stderr lines are capped at 16MiB so huge messages use bounded
+	// memory. Ignored with Binary or JSONRPC.
+	NDJSON bool
+	// Encoding, when set, decodes stdout and stderr from "utf16le",
+	// "utf16be" or, with "auto", from UTF-16 if the stream starts with a BOM,
+	// so the log is UTF-8. Forwarded data is never altered. Ignored with
+	// Binary or JSONRPC.
+	Encoding string
+	// MaxLine truncates logged stdout/stderr lines longer than this many
+	// bytes. Forwarded data is never truncated. 0 means no limit.
+	MaxLine int
+	// Match and NoMatch, when set, limit the stdout and stderr lines logged to
+	// those matching Match and not matching NoMatch. Everything is still
+	// forwarded. They don't apply with Binary or JSONRPC.
+	Match   *regexp.Regexp
+	NoMatch *regexp.Regexp
+	// Redact lists patterns whose matches are replaced with ***REDACTED***
+	// in the log. Forwarded data is never altered.
+	Redact []*regexp.Regexp
+	// StripANSI removes ANSI/VT escape sequences, such as colors and cursor
+	// movement, from the logged data, including sequences split across
+	// reads. Forwarded data is never altered. Ignored with Binary or JSONRPC.
+	StripANSI bool
+	// Annotate records the byte length and CRC32 of the data of each entry,
+	// as "[len=N crc=XXXXXXXX] " after the label or as the len and crc json
+	// fields, so truncation or corruption of shipped logs can be detected
+	Annotate bool
+
+	// BufferSize is the size of the buffer streams are read with, 4096 bytes
+	// if zero and at most maxBufferSize. Larger ones cut syscalls on busy
+	// binary streams; smaller ones suit interactive use.
+	BufferSize int
+
+	// StdinRaw logs stdin as the chunks it is read in rather than as lines,
+	// for protocols without line structure
+	StdinRaw bool
+	// KeepStdinOpen leaves the child's stdin open when the proxy's stdin
+	// closes, until the child exits, instead of passing the EOF on
+	KeepStdinOpen bool
+	// EOFSignal, when set, closes the child's stdin when the proxy receives
+	// it, so a filter reading until EOF finishes while the proxy's stdin is
+	// still open, as on a terminal; see EOFSignal for the names accepted
+	EOFSignal os.Signal
+	// WriteTimeout, when non-zero, stops forwarding stdin and closes the
+	// child's stdin if a write to it blocks this long, as when the child has
+	// stopped reading
+	WriteTimeout time.Duration
+
+	// ForwardSignals relays SIGINT/SIGTERM received by this process to the
+	// child, killing it if it is still running KillGrace later
+	ForwardSignals bool
+	KillGrace      time.Duration
+	// NoKill never force-kills a running child: forwarded signals, timeouts
+	// and cancellation only ask it to stop, and Run waits for it to exit
+	// however long that takes, so a hung child means Run hangs too
+	NoKill bool
+	// KillGroup starts the child in a process group of its own and sends
+	// signals and kills to the whole group, so the descendants of a shell
+	// wrapper are not orphaned. Unix only; ignored on Windows.
+	KillGroup bool
+
+	// TeardownTimeout, when non-zero, bounds how long Run waits for the
+	// child's output to drain once it has exited, as descendants holding
+	// its pipes open can delay that forever. The streams still open are then
+	// logged and their pipes closed, and Run goes on without them.
+	TeardownTimeout time.Duration
+
+	// ExecTimeout, when non-zero, stops the child once it has run this long,
+	// as if SIGTERM had been forwarded, logging "--- exec timeout,
+	// terminating ---". Its output then gets KillGrace to drain, as with
+	// TeardownTimeout. Run then returns exit code 124, like timeout(1).
+	ExecTimeout time.Duration
+
+	// Restart relaunches the child when it exits with a non-zero status,
+	// other than after a forwarded signal, logging into the same logs. It
+	// waits RestartBackoff before the first restart, doubling the wait for
+	// each further one up to maxBackoff, and gives up after MaxRestarts
+	// restarts if that is non-zero, returning the last exit code.
+	Restart        bool
+	MaxRestarts    int
+	RestartBackoff time.Duration
+
+	// LineIDs records the child's pid and a random session id, generated for
+	// each run, in every log line so logs of several proxies can be told apart
+	// once combined
+	LineIDs bool
+	// Label, when set, is recorded in every log line as "label=<Label>", or
+	// a label field in JSON, e.g. to name the proxy in combined logs. It
+	// must not contain spaces.
+	Label string
+	// Hostname, when set, is recorded in the header as "host: <Hostname>"
+	// and, with HostnameLines, in every log line as "host=<Hostname>" or a
+	// host field in JSON, before any label, to tell hosts apart in logs
+	// aggregated from a fleet. It must not contain spaces.
+	Hostname      string
+	HostnameLines bool
+
+	// Heartbeat, when non-zero, logs "--- idle (no activity for Ns) ---"
+	// whenever no data has crossed any stream for this long
+	Heartbeat time.Duration
+
+	// MetricsAddr, when set, serves the bytes forwarded on each stream and
+	// the number of restarts as Prometheus text at /metrics on this address,
+	// e.g. ":9090", while Run runs
+	MetricsAddr string
+
+	// Stats appends a summary of the bytes forwarded on each stream to the
+	// log once the streams close
+	Stats bool
+
+	// Stdin, Stdout and Stderr are the proxy's own streams, os.Stdin,
+	// os.Stdout and os.Stderr if nil. The child's stdout and stderr are
+	// forwarded to Stdout and Stderr respectively.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// StdinListen, when set, is a TCP address such as ":9000" on which one
+	// connection is accepted, in the background, to be the child's stdin
+	// in place of Stdin. Its opening and closing are logged as markers.
+	// With StdoutToConn the child's stdout is also sent back over it.
+	StdinListen  string
+	StdoutToConn bool
+	// ExtraFD, when 3 or more, gives the child a pipe as that file
+	// descriptor, for tools that report status on e.g. fd 3 to keep stdout
+	// clean, and logs what it writes there as "fd3: " (dir "fd3" in JSON).
+	// It is not forwarded anywhere. Unix only.
+	ExtraFD int
+	// StdoutFile and StderrFile, when set, also receive the child's stdout
+	// and stderr verbatim, without timestamps or labels, for byte-exact
+	// comparison. With Pipeline StdoutFile gets the last stage's stdout and
+	// StderrFile the first's stderr.
+	StdoutFile io.Writer
+	StderrFile io.Writer
+	// MergeStderr forwards the child's stderr to Stdout instead, like 2>&1.
+	// It is still logged as stderr.
+	MergeStderr bool
+	// StopOnStdoutClose shuts the child down, as on SIGTERM, once the
+	// proxy's stdout is found closed, e.g. when piped into head. Otherwise
+	// the child runs on, its output only logged.
+	StopOnStdoutClose bool
+	// Version is the proxy version recorded in the log header
+	Version string
+	// RunID, when set, is recorded in the header as "run id: <RunID>", to
+	// correlate the log with e.g. a CI job
+	RunID string
+	// LogEnv records the child's environment in the header, limited to the
+	// variables starting with one of LogEnvPrefixes if any are given. Values
+	// matching Redact, or of variables named like secrets, are redacted.
+	LogEnv         bool
+	LogEnvPrefixes []string
+	// SessionSeparator starts the header with a "new session" line, to
+	// delimit runs appended to the same log
+	SessionSeparator bool
+
+	// QuietStdout and QuietStderr stop the child's stdout or stderr from being
+	// echoed to the proxy's own streams. They are still logged.
+	QuietStdout bool
+	QuietStderr bool
+	// summary describes the last run, see Summary
+	summary Summary
+
+	// Color shows the child's stderr in red when the proxy's stderr is a
+	// terminal and NO_COLOR is unset. The log is never colored.
+	Color bool
+}
+
+// Summary describes a finished Run
+type Summary struct {
+	ExitCode int
+	// Signaled reports whether the child was terminated by a signal
+	Signaled bool
+	// BytesIn, BytesOut and BytesErr count the bytes forwarded on each stream
+	BytesIn, BytesOut, BytesErr int64
+	Duration                    time.Duration
+}
+
+// Summary returns the summary of the last Run, once it has returned
+func (p *Proxy) Summary() Summary {
+	return p.summary
+}
+
+// Prefixes are the labels of stdout and stderr entries. Either may be empty.
+type Prefixes struct {
+	Stdout string
+	Stderr string
+}
+
+// now returns the current time from Clock, or time.Now if it is nil
+func (p *Proxy) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock()
+	}
+	return time.Now()
+}
+
+// newLogger returns a logger writing to w with the proxy's format settings.
+// Loggers sharing mu never interleave their entries.
+func (p *Proxy) newLogger(w io.Writer, mu *sync.Mutex) *streamLog {
+	timeFormat := p.TimeFormat
+	if timeFormat == "" {
+		timeFormat = DefaultTimeFormat
+	}
+	format := p.Format
+	if format == "" {
+		format = "text"
+	}
+	maxLine := p.MaxLine
+	if p.NDJSON && maxLine == 0 {
+		maxLine = maxNDJSONLine
+	}
+	return &streamLog{mu: mu, w: w, format: format, timeFormat: timeFormat, local: p.Local, redact: p.Redact, maxLine: maxLine, binary: p.Binary, base64: p.Base64, bufferSize: p.BufferSize, annotate: p.Annotate, ndjson: p.NDJSON, noTime: p.NoTimestamp, noMarkers: p.NoMarkers, clock: p.now}
+}
+
+// header returns the lines describing a started child for the top of the log
+func (p *Proxy) header(cmd *exec.Cmd) []string {
+	version := p.Version
+	if version == "" {
+		version = "unknown"
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	var lines []string
+	if p.SessionSeparator {
+		lines = append(lines, fmt.Sprintf("new session %s pid=%d", p.now().UTC().Format(time.RFC3339), cmd.Process.Pid))
+	}
+	lines = append(lines,
+		fmt.Sprintf("stdio-logger %s on %s/%s", version, runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("started: %s", p.now().UTC().Format(time.RFC3339)),
+		fmt.Sprintf("command: %q args: %q", p.Command, p.Args),
+		fmt.Sprintf("pid: %d", cmd.Process.Pid),
+		fmt.Sprintf("cwd: %s", dir),
+	)
+	if p.Hostname != "" {
+		lines = append(lines, "host: "+p.Hostname)
+	}
+	if p.RunID != "" {
+		lines = append(lines, "run id: "+p.RunID)
+	}
+	if p.LogEnv {
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		for _, kv := range env {
+			if line, ok := p.envLine(kv); ok {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+// secretNames are substrings of environment variable names whose values are
+// never logged
+var secretNames = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "KEY", "CREDENTIAL", "AUTH"}
+
+// envLine returns the header line for one KEY=VALUE environment entry, and
+// false if LogEnvPrefixes excludes it
+func (p *Proxy) envLine(kv string) (string, bool) {
+	name, value, _ := strings.Cut(kv, "=")
+	if len(p.LogEnvPrefixes) > 0 && !slices.ContainsFunc(p.LogEnvPrefixes, func(prefix string) bool {
+		return strings.HasPrefix(name, prefix)
+	}) {
+		return "", false
+	}
+	upper := strings.ToUpper(name)
+	if slices.ContainsFunc(secretNames, func(secret string) bool { return strings.Contains(upper, secret) }) {
+		value = redactedText
+	}
+	for _, re := range p.Redact {
+		value = re.ReplaceAllLiteralString(value, redactedText)
+	}
+	return fmt.Sprintf("env: %s=%s", name, value), true
+}
+
+// newSessionID returns a short random id for the current run
+func newSessionID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// uniqueLogs returns the loggers that write to distinct destinations
+func uniqueLogs(logs ...*streamLog) []*streamLog {
+	var unique []*streamLog
+	seen := map[io.Writer]bool{}
+	for _, l := range logs {
+		if !seen[l.w] {
+			seen[l.w] = true
+			unique = append(unique, l)
+		}
+	}
+	return unique
+}
+
+// shells are the valid values of Proxy.Shell
+var shells = []string{"sh", "cmd", "powershell", "none"}
+
+// shell returns the shell Command is wrapped in
+func (p *Proxy) shell() string {
+	switch {
+	case p.NoShell:
+		return "none"
+	case p.Shell != "":
+		return p.Shell
+	case runtime.GOOS == "windows":
+		return "cmd"
+	default:
+		return "sh"
+	}
+}
+
+// shellPath returns the interpreter to run for the shell, ShellPath if set
+// and otherwise name
+func (p *Proxy) shellPath(name string) string {
+	if p.ShellPath != "" {
+		return p.ShellPath
+	}
+	return name
+}
+
+// command builds the child process, wrapping it in the selected shell
+func (p *Proxy) command(ctx context.Context) *exec.Cmd {
+	return p.commandFor(ctx, p.Command, p.Args)
+}
+
+// commandFor builds a child process running name with args, wrapped like
+// Command
+func (p *Proxy) commandFor(ctx context.Context, name string, args []string) *exec.Cmd {
+	var cmd *exec.Cmd
+	fullCmd := append([]string{name}, args...)
+	switch p.shell() {
+	case "none":
+		// Pass arguments verbatim so those containing spaces survive
+		cmd = exec.CommandContext(ctx, name, args...)
+	case "cmd":
+		// Use cmd.exe /C for Windows built-in commands
+		cmd = exec.CommandContext(ctx, p.shellPath("cmd.exe"), append([]string{"/C"}, fullCmd...)...)
+	case "powershell":
+		powershell := "powershell.exe"
+		if runtime.GOOS != "windows" {
+			powershell = "pwsh"
+		}
+		cmd = exec.CommandContext(ctx, p.shellPath(powershell), "-Command", strings.Join(fullCmd, " "))
+	default:
+		// Use sh -c for Unix-like systems
+		cmd = exec.CommandContext(ctx, p.shellPath("sh"), "-c", strings.Join(fullCmd, " "))
+	}
+	cmd.Dir = p.Dir
+	cmd.Env = p.Env
+	// On cancellation ask the child to stop, killing it if it is still
+	// running KillGrace later. With NoKill it is only asked, or on Windows,
+	// where it can't be, left to exit on its own.
+	if p.KillGroup && !p.PTY {
+		setProcessGroup(cmd)
+	}
+	switch {
+	case runtime.GOOS != "windows" && (p.KillGrace > 0 || p.NoKill):
+		cmd.Cancel = func() error { return signalProcess(cmd, syscall.SIGTERM, p.KillGroup) }
+		if !p.NoKill {
+			cmd.WaitDelay = p.KillGrace
+		}
+	case p.NoKill:
+		cmd.Cancel = func() error { return nil }
+	}
+	return cmd
+}
+
+// Check resolves the program Run would start, without starting it, and
+// returns its path and arguments. err is non-nil if the program or, when it
+// is wrapped in a shell, the first word of Command can't be found in PATH.
+func (p *Proxy) Check() (path string, args []string, err error) {
+	if !slices.Contains(shells, p.shell()) {
+		return "", nil, fmt.Errorf("invalid shell %q: must be sh, cmd, powershell or none", p.Shell)
+	}
+	cmd := p.command(context.Background())
+	if cmd.Err != nil {
+		return cmd.Path, cmd.Args, cmd.Err
+	}
+	if p.ShellPath != "" && p.shell() != "none" {
+		if _, err := exec.LookPath(p.ShellPath); err != nil {
+			return cmd.Path, cmd.Args, err
+		}
+	}
+	if p.shell() != "none" {
+		if fields := strings.Fields(p.Command); len(fields) > 0 {
+			if _, err := exec.LookPath(fields[0]); err != nil {
+				return cmd.Path, cmd.Args, err
+			}
+		}
+	}
+	return cmd.Path, cmd.Args, nil
+}
+
+// Run starts the command, forwards and logs its stdio until it exits and
+// returns its exit code, or 128+N if it was killed by signal N. err is
+// non-nil if the proxy itself failed, in which case exitCode is 1.
+// Cancelling ctx stops forwarding, closes the child's stdin and signals the
+// child to exit.
+func (p *Proxy) Run(ctx context.Context) (exitCode int, err error) {
+	if p.Format != "" && p.Format != "text" && p.Format != "json" && p.Format != "csv" {
+		return 1, fmt.Errorf("invalid format %q: must be text, json or csv", p.Format)
+	}
+	if p.ExtraFD != 0 && (p.ExtraFD < 3 || runtime.GOOS == "windows") {
+		return 1, fmt.Errorf("invalid extra fd %d: must be 3 or more, and is not supported on Windows", p.ExtraFD)
+	}
+	if !slices.Contains(shells, p.shell()) {
+		return 1, fmt.Errorf("invalid shell %q: must be sh, cmd, powershell or none", p.Shell)
+	}
+	if p.ShellPath != "" && p.shell() != "none" {
+		if _, err := exec.LookPath(p.ShellPath); err != nil {
+			return 1, fmt.Errorf("invalid shell path: %w", err)
+		}
+	}
+	if p.Encoding != "" {
+		if _, err := newDecoder(p.Encoding); err != nil {
+			return 1, err
+		}
+	}
+	for _, dir := range p.Dirs {
+		if dir != "in" && dir != "out" && dir != "err" {
+			return 1, fmt.Errorf("invalid stream %q: must be in, out or err", dir)
+		}
+	}
+	if p.BufferSize < 0 || p.BufferSize > maxBufferSize {
+		return 1, fmt.Errorf("invalid buffer size %d: must be between 1 and %d", p.BufferSize, maxBufferSize)
+	}
+	if p.MaxPending < 0 {
+		return 1, fmt.Errorf("invalid max pending %d: must not be negative", p.MaxPending)
+	}
+	if p.Framing != "" && p.Framing != "length32" {
+		return 1, fmt.Errorf("invalid framing %q: must be length32", p.Framing)
+	}
+	if p.Framing != "" && p.JSONRPC {
+		return 1, fmt.Errorf("framing %s can't be combined with JSON-RPC", p.Framing)
+	}
+	if p.Seq && p.Format == "csv" {
+		return 1, fmt.Errorf("sequence numbers can't be combined with csv format")
+	}
+	if p.PTY && len(p.Pipeline) > 0 {
+		return 1, fmt.Errorf("a pipeline can't run on a pty")
+	}
+	for _, stage := range p.Pipeline {
+		if len(stage) == 0 {
+			return 1, fmt.Errorf("empty pipeline stage")
+		}
+	}
+	if p.Log == nil {
+		return 1, fmt.Errorf("no log writer")
+	}
+	stdin, stdout, stderr := p.Stdin, p.Stdout, p.Stderr
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	if p.MergeStderr {
+		stderr = stdout
+	}
+	if p.Color && useColor(stderr) {
+		stderr = colorWriter{w: stderr, color: colorRed}
+	}
+	if p.QuietStdout {
+		stdout = io.Discard
+	}
+	if p.QuietStderr {
+		stderr = io.Discard
+	}
+
+	inW, outW, errW := p.Log, p.Log, p.Log
+	if p.StdoutLog != nil {
+		outW = p.StdoutLog
+	}
+	if p.StderrLog != nil {
+		errW = p.StderrLog
+	}
+	if len(p.Tee) > 0 {
+		teed := map[io.Writer]io.Writer{}
+		tee := func(w io.Writer) io.Writer {
+			if t, ok := teed[w]; ok {
+				return t
+			}
+			t := newTeeLog(w, p.Tee)
+			teed[w] = t
+			return t
+		}
+		inW, outW, errW = tee(inW), tee(outW), tee(errW)
+	}
+	var rings []*ringLog
+	if p.RingSize > 0 {
+		kept := map[io.Writer]*ringLog{}
+		ring := func(w io.Writer) io.Writer {
+			if r, ok := kept[w]; ok {
+				return r
+			}
+			r := newRingLog(w, p.RingSize)
+			kept[w] = r
+			rings = append(rings, r)
+			return r
+		}
+		inW, outW, errW = ring(inW), ring(outW), ring(errW)
+		// Runs last, once everything queued or batched has reached the rings
+		defer func() {
+			if exitCode == 0 && err == nil {
+				return
+			}
+			for _, r := range rings {
+				if dumpErr := r.dump(); dumpErr != nil {
+					log.Printf("Error writing to log file: %v", dumpErr)
+				}
+			}
+		}()
+	}
+	var gate *triggerGate
+	if p.Trigger != nil {
+		gate = &triggerGate{re: p.Trigger}
+		gated := map[io.Writer]*triggerLog{}
+		trigger := func(w io.Writer) io.Writer {
+			if t, ok := gated[w]; ok {
+				return t
+			}
+			t := gate.wrap(w, p.TriggerContext)
+			gated[w] = t
+			return t
+		}
+		inW, outW, errW = trigger(inW), trigger(outW), trigger(errW)
+	}
+	if p.FlushInterval > 0 {
+		// Wrap each distinct writer once so shared logs share one buffer
+		batched := map[io.Writer]*batchedLog{}
+		var logs []*batchedLog
+		batch := func(w io.Writer) io.Writer {
+			if b, ok := batched[w]; ok {
+				return b
+			}
+			b := newBatchedLog(w)
+			batched[w] = b
+			logs = append(logs, b)
+			return b
+		}
+		inW, outW, errW = batch(inW), batch(outW), batch(errW)
+		stopFlushing := flushEvery(p.FlushInterval, logs)
+		defer stopFlushing()
+	}
+	var asyncLogs []*asyncLog
+	if p.AsyncLog > 0 {
+		queued := map[io.Writer]*asyncLog{}
+		async := func(w io.Writer) io.Writer {
+			if a, ok := queued[w]; ok {
+				return a
+			}
+			a := newAsyncLog(w, p.AsyncLog)
+			queued[w] = a
+			asyncLogs = append(asyncLogs, a)
+			return a
+		}
+		inW, outW, errW = async(inW), async(outW), async(errW)
+		// Write out what is queued before any final flush
+		defer func() {
+			for _, a := range asyncLogs {
+				a.close()
+			}
+		}()
+	}
+	// Proxy events go to the stderr log
+	var logMu sync.Mutex
+	inLog, outLog, errLog := p.newLogger(inW, &logMu), p.newLogger(outW, &logMu), p.newLogger(errW, &logMu)
+	if p.StripANSI {
+		// Each stream has its own state, as a sequence may span its reads
+		inLog.ansi, outLog.ansi, errLog.ansi = &ansiStripper{}, &ansiStripper{}, &ansiStripper{}
+	}
+	if p.Seq {
+		seq := new(atomic.Int64)
+		inLog.seq, outLog.seq, errLog.seq = seq, seq, seq
+	}
+	if p.Turns {
+		lastDir := new(string)
+		inLog.lastDir, outLog.lastDir, errLog.lastDir = lastDir, lastDir, lastDir
+	}
+	if p.MaxTotal > 0 {
+		budget := &logBudget{max: p.MaxTotal}
+		inLog.budget, outLog.budget, errLog.budget = budget, budget, budget
+	}
+	for _, a := range asyncLogs {
+		a.marker = errLog.markerText
+	}
+	for _, r := range rings {
+		r.marker = errLog.markerText
+	}
+	if gate != nil {
+		gate.marker = errLog.markerText
+		inLog.trigger, outLog.trigger, errLog.trigger = gate, gate, gate
+	}
+	if p.Format == "csv" {
+		for _, l := range uniqueLogs(inLog, outLog, errLog) {
+			if err := l.columns(); err != nil {
+				log.Printf("Error writing to log file: %v", err)
+			}
+		}
+	}
+	if p.JSONRPC || p.Framing != "" {
+		maxPending := p.MaxPending
+		if maxPending == 0 {
+			maxPending = defaultMaxPending
+		}
+		newFramer := func() framer { return &rpcFramer{} }
+		if p.Framing == "length32" {
+			newFramer = func() framer { return &length32Framer{} }
+		}
+		newRPCLogs(newFramer, maxPending, p.JSONRPCIndex, inLog, outLog)
+	}
+	outLog.encoding, errLog.encoding = p.Encoding, p.Encoding
+	outLog.match, errLog.match = p.Match, p.Match
+	outLog.noMatch, errLog.noMatch = p.NoMatch, p.NoMatch
+	if p.Dirs != nil {
+		inLog.muted = !slices.Contains(p.Dirs, "in")
+		outLog.muted = !slices.Contains(p.Dirs, "out")
+		errLog.muted = !slices.Contains(p.Dirs, "err")
+	}
+	inLog.label, outLog.label, errLog.label = p.Label, p.Label, p.Label
+	if p.HostnameLines {
+		inLog.host, outLog.host, errLog.host = p.Hostname, p.Hostname, p.Hostname
+	}
+	if p.Syslog != nil {
+		inLog.syslog, outLog.syslog, errLog.syslog = &p.Syslog.in, &p.Syslog.out, &p.Syslog.err
+	}
+
+	var conn *stdinConn
+	if p.StdinListen != "" {
+		var err error
+		if conn, err = listenStdin(p.StdinListen, inLog); err != nil {
+			return 1, fmt.Errorf("listening for stdin: %w", err)
+		}
+		defer conn.Close()
+		stdin = conn
+	}
+
+	// One reader serves every run of the child, so input read after one exits
+	// goes to the next
+	var stats streamStats
+	started := time.Now()
+	if p.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(p.MetricsAddr, &stats)
+		if err != nil {
+			return 1, fmt.Errorf("serving metrics: %w", err)
+		}
+		defer stopMetrics()
+	}
+	var beat *heartbeat
+	if p.Heartbeat > 0 {
+		beat = startHeartbeat(p.Heartbeat, errLog)
+		defer beat.stop()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	r := &childRun{
+		stdin: stdin, stdout: stdout, stderr: stderr,
+		inLog: inLog, outLog: outLog, errLog: errLog,
+		input:     readChunks(&progressReader{r: countingReader{r: stdin, n: &stats.in, heartbeat: beat}, logger: inLog, stream: "stdin"}, inLog.readSize(), done),
+		stats:     &stats,
+		heartbeat: beat,
+	}
+	if p.LineIDs {
+		r.session = newSessionID()
+	}
+	if p.StdoutFile != nil {
+		r.stdoutCopy = &rawCopy{w: p.StdoutFile, name: "stdout"}
+	}
+	if p.StderrFile != nil {
+		r.stderrCopy = &rawCopy{w: p.StderrFile, name: "stderr"}
+	}
+	if stdout != io.Discard {
+		defer catchSIGPIPE()()
+		r.downstream = newDownstreamWriter(stdout, errLog, p.StopOnStdoutClose)
+		r.stdout = r.downstream
+	}
+	if conn != nil && p.StdoutToConn {
+		r.stdout = io.MultiWriter(r.stdout, conn)
+	}
+	backoff := p.RestartBackoff
+	for restarts := 0; ; restarts++ {
+		var signalled bool
+		exitCode, signalled, err = p.runChild(ctx, r)
+		if err != nil || exitCode == 0 || signalled || !p.Restart || ctx.Err() != nil ||
+			(p.MaxRestarts > 0 && restarts == p.MaxRestarts) ||
+			(p.StopOnStdoutClose && r.downstream != nil && r.downstream.isClosed()) {
+			break
+		}
+		if err := errLog.marker("restart", fmt.Sprintf("restart #%d after %v", restarts+1, backoff)); err != nil {
+			log.Printf("Error writing to log file: %v", err)
+		}
+		if !sleepUnlessSignalled(ctx, backoff) {
+			break
+		}
+		stats.restarts.Add(1)
+		backoff = min(backoff*2, maxBackoff)
+	}
+
+	if p.Stats {
+		if err := errLog.marker("stats", stats.summary()); err != nil {
+			log.Printf("Error writing to log file: %v", err)
+		}
+	}
+	p.summary = Summary{
+		ExitCode: exitCode,
+		Signaled: r.signaled,
+		BytesIn:  stats.in.Load(),
+		BytesOut: stats.out.Load(),
+		BytesErr: stats.err.Load(),
+		Duration: time.Since(started),
+	}
+	return exitCode, err
+}
+
+// childRun holds what every run of the child shares
+type childRun struct {
+	stdin                  io.Reader
+	stdout, stderr         io.Writer
+	inLog, outLog, errLog  *streamLog
+	input                  <-chan readResult // the proxy's stdin
+	stats                  *streamStats
+	heartbeat              *heartbeat        // or nil
+	stdoutCopy, stderrCopy io.Writer         // raw copies of the streams, or nil
+	downstream             *downstreamWriter // wraps stdout unless it is discarded
+	session                string
+	signaled               bool // the last run was terminated by a signal
+}
+
+// runChild runs the child once, forwarding and logging its streams until it
+// exits. signalled reports whether a signal was forwarded to it.
+func (p *Proxy) runChild(ctx context.Context, r *childRun) (exitCode int, signalled bool, err error) {
+	stdin, stdout, stderr := r.stdin, r.stdout, r.stderr
+	inLog, outLog, errLog := r.inLog, r.outLog, r.errLog
+	stats := r.stats
+
+	cmd := p.command(ctx)
+
+	var (
+		targetStdin  io.WriteCloser
+		targetStdout io.ReadCloser
+		targetStderr io.ReadCloser // nil in PTY mode, where stderr is merged into stdout
+		startErr     error
+	)
+	var extraFD, extraW *os.File
+	if p.ExtraFD > 0 {
+		if extraFD, extraW, err = os.Pipe(); err != nil {
+			return 1, false, fmt.Errorf("creating fd %d pipe: %w", p.ExtraFD, err)
+		}
+		defer extraFD.Close()
+		// Lower descriptors left nil are closed in the child
+		cmd.ExtraFiles = make([]*os.File, p.ExtraFD-2)
+		cmd.ExtraFiles[p.ExtraFD-3] = extraW
+	}
+	if p.PTY {
+		var stopPTY func()
+		targetStdin, targetStdout, stopPTY, startErr = startPTY(cmd, stdin)
+		if startErr == nil {
+			defer targetStdout.Close()
+			defer stopPTY()
+		}
+	} else {
+		// Set up pipes for stdin, stdout and stderr
+		targetStdin, err = cmd.StdinPipe()
+		if err != nil {
+			return 1, false, fmt.Errorf("creating stdin pipe: %w", err)
+		}
+
+		stdoutPipe, stderrPipe, started, err := outputPipes(cmd)
+		if err != nil {
+			return 1, false, fmt.Errorf("creating output pipes: %w", err)
+		}
+		defer stdoutPipe.Close()
+		defer stderrPipe.Close()
+		targetStdout, targetStderr = stdoutPipe, stderrPipe
+
+		// Start the target process
+		startErr = cmd.Start()
+		started()
+	}
+	if extraW != nil {
+		extraW.Close() // the child has its own copy now
+	}
+	if startErr != nil {
+		// Try to log the error too
+		if logErr := errLog.write(fmt.Sprintf("!!! Logger Error: %v\n", startErr)); logErr != nil {
+			log.Printf("Error writing to log file: %v", logErr)
+		}
+		return 1, false, fmt.Errorf("starting command: %w", startErr)
+	}
+
+	// Start the later pipeline stages, each reading the previous one's stdout
+	var stages []*pipelineStage
+	for i, stageArgs := range p.Pipeline {
+		stage, err := p.startStage(ctx, stageArgs)
+		if err != nil {
+			if logErr := errLog.write(fmt.Sprintf("!!! Logger Error: %v\n", err)); logErr != nil {
+				log.Printf("Error writing to log file: %v", logErr)
+			}
+			for _, c := range append([]*exec.Cmd{cmd}, stagesCmds(stages)...) {
+				signalProcess(c, os.Kill, p.KillGroup)
+				c.Wait()
+			}
+			return 1, false, fmt.Errorf("starting pipeline stage %d: %w", i+2, err)
+		}
+		defer stage.stdout.Close()
+		defer stage.stderr.Close()
+		stages = append(stages, stage)
+	}
+
+	if p.LineIDs {
+		// Under the logs' shared lock, as the heartbeat and the previous
+		// child's late markers may be logging
+		inLog.mu.Lock()
+		for _, l := range []*streamLog{inLog, outLog, errLog} {
+			l.pid, l.session = cmd.Process.Pid, r.session
+		}
+		inLog.mu.Unlock()
+	}
+
+	// Record what was launched before any stream output is logged
+	header := p.header(cmd)
+	for i, stage := range stages {
+		header = append(header, fmt.Sprintf("stage %d: %q pid: %d", i+2, p.Pipeline[i], stage.cmd.Process.Pid))
+	}
+	for _, l := range uniqueLogs(inLog, outLog, errLog) {
+		for _, line := range header {
+			if err := l.marker("header", line); err != nil {
+				log.Printf("Error writing to log file: %v", err)
+			}
+		}
+	}
+
+	var shutdown <-chan struct{}
+	if p.StopOnStdoutClose && r.downstream != nil {
+		shutdown = r.downstream.closed
+	}
+	var execExpired <-chan struct{}
+	if p.ForwardSignals || p.ExecTimeout > 0 || shutdown != nil {
+		// Relay SIGINT/SIGTERM so the child can shut down gracefully, and
+		// stop it the same way once ExecTimeout elapses or the proxy's
+		// stdout closes
+		var stopSignals func() (bool, bool)
+		stopSignals, execExpired = forwardSignals(append([]*exec.Cmd{cmd}, stagesCmds(stages)...), errLog, p.KillGrace, !p.NoKill, p.KillGroup, p.ForwardSignals, p.ExecTimeout, shutdown)
+		defer func() {
+			var timedOut bool
+			signalled, timedOut = stopSignals()
+			if timedOut && err == nil {
+				exitCode, signalled = execTimeoutCode, true
+			}
+		}()
+	}
+
+	prefixes := Prefixes{Stdout: "out: ", Stderr: "err: "}
+	if p.Prefixes != nil {
+		prefixes = *p.Prefixes
+	}
+	// The labels are settled before any stream is logged
+	stderrDir, stderrPrefix := "err", prefixes.Stderr
+	if len(stages) > 0 {
+		stderrDir, stderrPrefix = "err1", "err1: "
+	}
+	if p.AlignPrefixes {
+		labels := []string{"in:  ", prefixes.Stdout, stderrPrefix}
+		for i := range stages {
+			labels = append(labels, fmt.Sprintf("out%d: ", i+1), fmt.Sprintf("err%d: ", i+2))
+		}
+		if p.ExtraFD > 0 {
+			labels = append(labels, fmt.Sprintf("fd%d: ", p.ExtraFD))
+		}
+		width := 0
+		for _, label := range labels {
+			width = max(width, len(label))
+		}
+		inLog.labelWidth, outLog.labelWidth, errLog.labelWidth = width, width, width
+	}
+
+	var stdinWg sync.WaitGroup
+	var wg streamGroup
+
+	// Start forwarding stdin. It also stops once the child has exited, as the
+	// proxy's stdin may stay open long after nothing reads it.
+	stdinCtx, stopStdin := context.WithCancel(ctx)
+	defer stopStdin()
+	stdinWg.Add(1)
+	var eof chan os.Signal
+	if p.EOFSignal != nil {
+		eof = make(chan os.Signal, 1)
+		signal.Notify(eof, p.EOFSignal)
+		defer signal.Stop(eof)
+	}
+	go forwardAndLogStdin(stdinCtx, r.input, targetStdin, inLog, p.StdinRaw, p.WriteTimeout, p.KeepStdinOpen, eof, &stdinWg)
+
+	// The output forwarders stop early if teardown times out
+	streamCtx, stopStreams := context.WithCancel(ctx)
+	defer stopStreams()
+
+	// Pass each stage's stdout on to the next, logging it on the way
+	for i, stage := range stages {
+		n := strconv.Itoa(i + 1)
+		wg.add("out" + n)
+		go func(output io.ReadCloser) {
+			forwardAndLogStream(streamCtx, output, &pipeWriter{w: stage.stdin, src: output}, outLog, "out"+n, "out"+n+": ", &wg)
+			stage.stdin.Close()
+		}(targetStdout)
+		wg.add("err" + strconv.Itoa(i+2))
+		go forwardAndLogStream(streamCtx, stage.stderr, stderr, errLog, "err"+strconv.Itoa(i+2), "err"+strconv.Itoa(i+2)+": ", &wg)
+		targetStdout = stage.stdout
+	}
+
+	// Start forwarding stdout
+	wg.add("out")
+	go forwardAndLogStream(streamCtx, countingReader{r: targetStdout, n: &stats.out, lines: &stats.linesOut, heartbeat: r.heartbeat, copy: r.stdoutCopy}, stdout, outLog, "out", prefixes.Stdout, &wg)
+
+	// Start forwarding stderr
+	if targetStderr != nil {
+		wg.add(stderrDir)
+		go forwardAndLogStream(streamCtx, countingReader{r: targetStderr, n: &stats.err, heartbeat: r.heartbeat, copy: r.stderrCopy}, stderr, errLog, stderrDir, stderrPrefix, &wg)
+	}
+
+	// Log the extra descriptor, which goes nowhere else
+	if extraFD != nil {
+		dir := "fd" + strconv.Itoa(p.ExtraFD)
+		wg.add(dir)
+		go forwardAndLogStream(streamCtx, extraFD, io.Discard, errLog, dir, dir+": ", &wg)
+	}
+
+	// Wait for the command to finish while its output drains. A
+	// pipeline's status is its last stage's, as in a shell.
+	var waitErr error
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		waitCmd := cmd
+		waitErr = cmd.Wait()
+		for i, stage := range stages {
+			if waitErr != nil {
+				if err := errLog.marker("stage_exited", fmt.Sprintf("stage %d exited: %v", i+1, waitErr)); err != nil {
+					log.Printf("Error writing to log file: %v", err)
+				}
+			}
+			waitCmd, waitErr = stage.cmd, stage.cmd.Wait()
+		}
+		cmd = waitCmd
+	}()
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	<-exited
+
+	// Wait for the child's output to drain, which descendants still holding
+	// its pipes can hold up, for at most TeardownTimeout if set. Once
+	// ExecTimeout has stopped the child they get KillGrace at most too, as
+	// a shell wrapper's workload outlives SIGTERM to the shell.
+	var teardown, execGrace <-chan time.Time
+	if p.TeardownTimeout > 0 {
+		teardown = time.After(p.TeardownTimeout)
+	}
+	giveUp := func(after time.Duration) {
+		if err := errLog.marker("teardown_timeout", fmt.Sprintf("teardown timeout after %v, not drained: %s", after, strings.Join(wg.open(), ", "))); err != nil {
+			log.Printf("Error writing to log file: %v", err)
+		}
+		// Closing the pipes unblocks the reads; forwarders stuck writing
+		// are left behind
+		stopStreams()
+	}
+drain:
+	for {
+		select {
+		case <-drained:
+			break drain
+		case <-execExpired:
+			execExpired = nil
+			execGrace = time.After(p.KillGrace)
+		case <-execGrace:
+			giveUp(p.KillGrace)
+			break drain
+		case <-teardown:
+			giveUp(p.TeardownTimeout)
+			break drain
+		}
+	}
+
+	// The child is gone, so stop forwarding stdin to it
+	stopStdin()
+	stdinWg.Wait()
+
+	r.signaled = false
+	if err := waitErr; err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			exitCode = exitError.ExitCode()
+			if sig, ok := exitSignal(exitError); ok {
+				r.signaled = true
+				// Exit like a shell would for a child killed by a signal
+				exitCode = 128 + int(sig)
+				if err := errLog.marker("signaled", fmt.Sprintf("child terminated by signal %d", int(sig))); err != nil {
+					log.Printf("Error writing to log file: %v", err)
+				}
+				if text, ok := crashMarker(exitError); ok {
+					if err := errLog.marker("crash", text); err != nil {
+						log.Printf("Error writing to log file: %v", err)
+					}
+				}
+			}
+		} else {
+			// Try to log the error too
+			if logErr := errLog.write(fmt.Sprintf("!!! Command Error: %v\n", err)); logErr != nil {
+				log.Printf("Error writing to log file: %v", logErr)
+			}
+			// Waiting failed, so make sure the child is not left running
+			if !p.NoKill {
+				if killErr := signalProcess(cmd, os.Kill, p.KillGroup); killErr != nil && !errors.Is(killErr, os.ErrProcessDone) {
+					log.Printf("Error killing process: %v", killErr)
+				}
+			}
+			return 1, false, fmt.Errorf("command finished with error: %w", err)
+		}
+	}
+
+	return exitCode, false, nil
+}
@@ -0,0 +1,217 @@
+package stdiolog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// pidLine matches the header line that differs from run to run
+var pidLine = regexp.MustCompile(`pid: \d+`)
+
+// checkGolden compares got with testdata/name, or rewrites it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("log differs from %s:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestRunGolden(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("cat not found")
+	}
+	// Each stream gets its own log, as its entries are ordered only among
+	// themselves
+	var inLog, outLog, errLog, stdout bytes.Buffer
+	p := &Proxy{
+		Command:   "cat",
+		Shell:     "none",
+		Dir:       "testdata",
+		Version:   "test",
+		Clock:     func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+		Log:       &inLog,
+		StdoutLog: &outLog,
+		StderrLog: &errLog,
+		Stdin:     strings.NewReader("hello\nworld\n"),
+		Stdout:    &stdout,
+		Stderr:    &bytes.Buffer{},
+	}
+	exitCode, err := p.Run(context.Background())
+	if err != nil || exitCode != 0 {
+		t.Fatalf("Run = %d, %v", exitCode, err)
+	}
+	if stdout.String() != "hello\nworld\n" {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	var got strings.Builder
+	for _, log := range []struct {
+		name string
+		buf  *bytes.Buffer
+	}{{"in", &inLog}, {"out", &outLog}, {"err", &errLog}} {
+		text := pidLine.ReplaceAllString(log.buf.String(), "pid: PID")
+		text = strings.ReplaceAll(text, runtime.GOOS+"/"+runtime.GOARCH, "GOOS/GOARCH")
+		got.WriteString("== " + log.name + " ==\n" + text)
+	}
+	checkGolden(t, "cat.golden", got.String())
+}
+
+func TestRunLogsTailOfExitingCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// The command exits as soon as it has written, without a final newline,
+	// so its last line is only logged if the pipe is drained after it exits
+	for i := range 50 {
+		var log, stdout bytes.Buffer
+		p := &Proxy{
+			Command: "sh",
+			Args:    []string{"-c", "seq 1 1000; printf tail"},
+			Shell:   "none",
+			Log:     &log,
+			Stdin:   strings.NewReader(""),
+			Stdout:  &stdout,
+			Stderr:  &bytes.Buffer{},
+		}
+		if exitCode, err := p.Run(context.Background()); err != nil || exitCode != 0 {
+			t.Fatalf("run %d: Run = %d, %v", i, exitCode, err)
+		}
+		if !strings.HasSuffix(stdout.String(), "1000\ntail") {
+			t.Fatalf("run %d: stdout ends %q", i, stdout.String()[max(0, stdout.Len()-20):])
+		}
+		if !strings.Contains(log.String(), "out: 1000\n") || !strings.Contains(log.String(), "out: tail␊(no-nl)\n") {
+			t.Fatalf("run %d: tail missing from log:\n%s", i, log.String()[max(0, log.Len()-300):])
+		}
+	}
+}
+
+// lockedBuffer is a log that forwarders left behind by a teardown timeout
+// may still write to once Run has returned
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestExecTimeoutBoundsDrain(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// SIGTERM stops the shell, but the sleep it started keeps its pipes
+	// open
+	var log lockedBuffer
+	p := &Proxy{
+		Command:     "sleep 10; echo done",
+		ExecTimeout: 100 * time.Millisecond,
+		KillGrace:   100 * time.Millisecond,
+		Log:         &log,
+		Stdin:       strings.NewReader(""),
+		Stdout:      &bytes.Buffer{},
+		Stderr:      &bytes.Buffer{},
+	}
+	start := time.Now()
+	exitCode, err := p.Run(context.Background())
+	if err != nil || exitCode != execTimeoutCode {
+		t.Fatalf("Run = %d, %v, want %d", exitCode, err, execTimeoutCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run took %v", elapsed)
+	}
+	if !strings.Contains(log.String(), "--- teardown timeout after 100ms, not drained: ") {
+		t.Errorf("no teardown timeout in log:\n%s", log.String())
+	}
+}
+
+func TestLineIDsAcrossRestarts(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// Each restart sets the ids while the heartbeat logs, which -race checks
+	var log lockedBuffer
+	p := &Proxy{
+		Command:        "sleep 0.05; exit 1",
+		LineIDs:        true,
+		Heartbeat:      5 * time.Millisecond,
+		Restart:        true,
+		MaxRestarts:    3,
+		RestartBackoff: 10 * time.Millisecond,
+		Log:            &log,
+		Stdin:          strings.NewReader(""),
+		Stdout:         &bytes.Buffer{},
+		Stderr:         &bytes.Buffer{},
+	}
+	if exitCode, err := p.Run(context.Background()); err != nil || exitCode != 1 {
+		t.Fatalf("Run = %d, %v", exitCode, err)
+	}
+	if !strings.Contains(log.String(), "session=") {
+		t.Errorf("no ids in log:\n%s", log.String())
+	}
+}
+
+func TestCheckMissingCommand(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	tests := []struct {
+		name    string
+		p       Proxy
+		missing string // the program reported missing, or "" if found
+	}{
+		{"no shell", Proxy{Command: "no-such-command-stdio-logger", NoShell: true}, "no-such-command-stdio-logger"},
+		{"no shell found", Proxy{Command: "sh", NoShell: true}, ""},
+		{"shell first word", Proxy{Command: "no-such-command-stdio-logger --flag", Args: []string{"x"}}, "no-such-command-stdio-logger"},
+		{"shell found", Proxy{Command: "sh -c true"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.p.Check()
+			if tt.missing == "" {
+				if err != nil {
+					t.Errorf("Check = %v, want nil", err)
+				}
+				return
+			}
+			var execErr *exec.Error
+			if !errors.As(err, &execErr) {
+				t.Fatalf("Check = %v, want an *exec.Error", err)
+			}
+			if execErr.Name != tt.missing {
+				t.Errorf("missing %q, want %q", execErr.Name, tt.missing)
+			}
+		})
+	}
+}
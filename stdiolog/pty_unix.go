@@ -0,0 +1,84 @@
+//go:build !windows
+
+package stdiolog
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// ptyInput is the child's stdin when it runs on a pseudo-terminal. Closing it
+// sends EOF (Ctrl-D) to the terminal instead of closing the master, which
+// would also cut off the child's output.
+type ptyInput struct {
+	*os.File
+}
+
+func (p ptyInput) Close() error {
+	_, err := p.Write([]byte{4})
+	return err
+}
+
+// ptyOutput is the child's output when it runs on a pseudo-terminal. Reading
+// the master fails with EIO once the child has exited, which it reports as
+// io.EOF, the normal end of the output.
+type ptyOutput struct {
+	*os.File
+}
+
+func (p ptyOutput) Read(b []byte) (int, error) {
+	n, err := p.File.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// startPTY starts cmd attached to a new pseudo-terminal and returns the
+// child's input and combined output through its master side. If stdin is a
+// terminal it is switched to raw mode and its size is mirrored onto the
+// pseudo-terminal, including on SIGWINCH. The returned stop function restores
+// the terminal and must be called once the child exits.
+func startPTY(cmd *exec.Cmd, stdin io.Reader) (input io.WriteCloser, output io.ReadCloser, stop func(), err error) {
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stdinFile, ok := stdin.(*os.File)
+	if !ok || !term.IsTerminal(int(stdinFile.Fd())) {
+		return ptyInput{ptmx}, ptyOutput{ptmx}, func() {}, nil
+	}
+
+	// Forward terminal resizes to the child
+	resize := make(chan os.Signal, 1)
+	signal.Notify(resize, syscall.SIGWINCH)
+	go func() {
+		for range resize {
+			if err := pty.InheritSize(stdinFile, ptmx); err != nil {
+				log.Printf("Error resizing pty: %v", err)
+			}
+		}
+	}()
+	resize <- syscall.SIGWINCH // Set the initial size
+
+	oldState, err := term.MakeRaw(int(stdinFile.Fd()))
+	if err != nil {
+		log.Printf("Error setting terminal to raw mode: %v", err)
+	}
+	return ptyInput{ptmx}, ptyOutput{ptmx}, func() {
+		signal.Stop(resize)
+		close(resize)
+		if oldState != nil {
+			term.Restore(int(stdinFile.Fd()), oldState)
+		}
+	}, nil
+}
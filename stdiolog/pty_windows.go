@@ -0,0 +1,12 @@
+package stdiolog
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+)
+
+// startPTY is not supported on Windows
+func startPTY(cmd *exec.Cmd, stdin io.Reader) (input io.WriteCloser, output io.ReadCloser, stop func(), err error) {
+	return nil, nil, nil, errors.New("pty mode is not supported on windows")
+}
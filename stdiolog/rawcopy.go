@@ -0,0 +1,26 @@
+package stdiolog
+
+import (
+	"io"
+	"log"
+)
+
+// rawCopy receives the bytes of one of the child's streams exactly as read,
+// for Proxy.StdoutFile and Proxy.StderrFile. A failed write is reported
+// once and the copy given up, without disturbing forwarding or the log.
+type rawCopy struct {
+	w      io.Writer
+	name   string
+	failed bool
+}
+
+func (c *rawCopy) Write(p []byte) (int, error) {
+	if c.failed {
+		return len(p), nil
+	}
+	if _, err := c.w.Write(p); err != nil {
+		log.Printf("Error writing %s copy, giving it up: %v", c.name, err)
+		c.failed = true
+	}
+	return len(p), nil
+}
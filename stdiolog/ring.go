@@ -0,0 +1,57 @@
+package stdiolog
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ringLog keeps the most recent log entries, up to size bytes, in memory
+// instead of writing them, so nothing reaches the disk unless dump is called
+type ringLog struct {
+	mu      sync.Mutex
+	w       io.Writer
+	size    int
+	entries [][]byte
+	total   int                             // bytes held in entries
+	dropped int                             // entries dropped to make room
+	marker  func(event, text string) string // formats the dropped entries marker
+}
+
+func newRingLog(w io.Writer, size int) *ringLog {
+	return &ringLog{w: w, size: size}
+}
+
+// Write keeps a copy of one entry, dropping the oldest entries to make room
+func (r *ringLog) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, append([]byte(nil), p...))
+	r.total += len(p)
+	for r.total > r.size && len(r.entries) > 1 {
+		r.total -= len(r.entries[0])
+		r.entries[0] = nil
+		r.entries = r.entries[1:]
+		r.dropped++
+	}
+	return len(p), nil
+}
+
+// dump writes the entries held to the underlying writer, after a marker
+// counting those dropped, and syncs it
+func (r *ringLog) dump() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped > 0 && r.marker != nil {
+		if _, err := io.WriteString(r.w, r.marker("ring_entries_dropped", fmt.Sprintf("%d earlier log entries dropped from the ring buffer", r.dropped))); err != nil {
+			return err
+		}
+	}
+	for _, entry := range r.entries {
+		if _, err := r.w.Write(entry); err != nil {
+			return err
+		}
+	}
+	r.entries, r.total, r.dropped = nil, 0, 0
+	return syncWriter(r.w)
+}
@@ -0,0 +1,119 @@
+package stdiolog
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// forwardSignals relays SIGINT and SIGTERM received by the proxy to the
+// children so they can shut down gracefully, if forward is set. With timeout
+// non-zero the children are sent SIGTERM once it elapses, the same way, as
+// they are when shutdown is closed. Any still running grace after a signal
+// are killed, unless kill is false. With group set whole process groups
+// are signalled and killed rather than just the children. expired is
+// closed once the timeout elapses. The returned function stops forwarding,
+// reporting whether any signal was forwarded and whether the timeout
+// elapsed, and must be called once the children have exited.
+func forwardSignals(cmds []*exec.Cmd, logger *streamLog, grace time.Duration, kill, group, forward bool, timeout time.Duration, shutdown <-chan struct{}) (stop func() (forwarded, timedOut bool), expired <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	if forward {
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	done := make(chan struct{})
+	timedOut := make(chan struct{})
+	var signalled atomic.Bool
+
+	go func() {
+		var killTimer <-chan time.Time
+		terminate := func(sig os.Signal) {
+			for _, cmd := range cmds {
+				if err := signalProcess(cmd, sig, group); err != nil && !errors.Is(err, os.ErrProcessDone) {
+					log.Printf("Error forwarding signal: %v", err)
+				}
+			}
+			if kill && killTimer == nil {
+				killTimer = time.After(grace)
+			}
+		}
+		for {
+			select {
+			case sig := <-signals:
+				signalled.Store(true)
+				terminate(sig)
+				if err := logger.marker("signal_forwarded", "signal forwarded: "+sig.String()); err != nil {
+					log.Printf("Error writing to log file: %v", err)
+				}
+			case <-deadline:
+				close(timedOut)
+				if err := logger.marker("exec_timeout", "exec timeout, terminating"); err != nil {
+					log.Printf("Error writing to log file: %v", err)
+				}
+				terminate(syscall.SIGTERM)
+			case <-shutdown:
+				shutdown = nil // closed, so it would be ready again at once
+				signalled.Store(true)
+				terminate(syscall.SIGTERM)
+			case <-killTimer:
+				for _, cmd := range cmds {
+					if err := signalProcess(cmd, os.Kill, group); err == nil {
+						log.Printf("Child still running %v after signal, killed it", grace)
+					} else if !errors.Is(err, os.ErrProcessDone) {
+						log.Printf("Error killing process: %v", err)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() (bool, bool) {
+		signal.Stop(signals)
+		close(done)
+		select {
+		case <-timedOut:
+			return signalled.Load(), true
+		default:
+			return signalled.Load(), false
+		}
+	}, timedOut
+}
+
+// catchSIGPIPE has SIGPIPE delivered to a channel nobody reads rather than
+// killing the proxy, so writes to a pipe whose reader went away fail with a
+// broken pipe error that can be handled. Unlike ignoring it, this leaves
+// SIGPIPE at its default for the child. The returned function undoes it.
+func catchSIGPIPE() (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGPIPE)
+	return func() { signal.Stop(signals) }
+}
+
+// maxBackoff caps the wait between restarts of the child
+const maxBackoff = time.Minute
+
+// sleepUnlessSignalled waits d before a restart, returning false if ctx is
+// cancelled or SIGINT or SIGTERM arrives first
+func sleepUnlessSignalled(ctx context.Context, d time.Duration) bool {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
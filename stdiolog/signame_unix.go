@@ -0,0 +1,24 @@
+//go:build !windows
+
+package stdiolog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// EOFSignal returns the signal named "hup", "usr1" or "usr2", with or
+// without a SIG prefix and in any case, for Proxy.EOFSignal
+func EOFSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return nil, fmt.Errorf("invalid signal %q: must be hup, usr1 or usr2", name)
+}
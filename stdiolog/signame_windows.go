@@ -0,0 +1,11 @@
+package stdiolog
+
+import (
+	"fmt"
+	"os"
+)
+
+// EOFSignal always fails on Windows, which has no user signals
+func EOFSignal(name string) (os.Signal, error) {
+	return nil, fmt.Errorf("signal %q is not supported on Windows", name)
+}
@@ -0,0 +1,57 @@
+package stdiolog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// streamStats counts the data forwarded on each stream. The counters are
+// updated concurrently by the forwarding goroutines.
+type streamStats struct {
+	in, out, err atomic.Int64
+	linesOut     atomic.Int64
+	restarts     atomic.Int64
+}
+
+// summary formats the counters for the closing stats marker
+func (s *streamStats) summary() string {
+	return fmt.Sprintf("stats: in=%dB out=%dB err=%dB lines_out=%d",
+		s.in.Load(), s.out.Load(), s.err.Load(), s.linesOut.Load())
+}
+
+// countingReader adds the number of bytes read to n and, if lines is set,
+// the number of newlines to lines. Reads of data also count as activity for
+// the heartbeat, if any, and are written to copy, if set.
+type countingReader struct {
+	r         io.Reader
+	n         *atomic.Int64
+	lines     *atomic.Int64
+	heartbeat *heartbeat
+	copy      io.Writer
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	if n > 0 {
+		c.heartbeat.active()
+		if c.copy != nil {
+			c.copy.Write(p[:n])
+		}
+	}
+	if c.lines != nil {
+		c.lines.Add(int64(bytes.Count(p[:n], []byte{'\n'})))
+	}
+	return n, err
+}
+
+// Close closes the underlying reader, if it is a Closer, so cancellation can
+// still unblock a pending read
+func (c countingReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
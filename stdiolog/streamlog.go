@@ -0,0 +1,408 @@
+package stdiolog
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redactedText replaces log substrings matching a redaction pattern
+const redactedText = "***REDACTED***"
+
+// noNewlineText ends a text log line whose data had no trailing newline, so
+// the newline the log adds can be told apart from a real one
+const noNewlineText = "␊(no-nl)"
+
+// streamLog writes forwarded data to the log in the configured format. The
+// loggers of all streams share mu, so each entry reaches the log as a whole
+// even when the streams are logged concurrently.
+type streamLog struct {
+	mu         *sync.Mutex
+	w          io.Writer
+	format     string // "text", "json" or "csv"
+	timeFormat string
+	local      bool // use local time instead of UTC
+	redact     []*regexp.Regexp
+	maxLine    int              // longest logged line, 0 for no limit
+	bufferSize int              // read buffer size, defaultBufferSize if 0
+	binary     bool             // log data as a hex dump
+	base64     bool             // log data base64-encoded, one line per entry
+	offset     int64            // bytes logged so far, for hex dump addresses
+	rpc        framer           // set to log framed messages instead of raw data
+	rpcIndex   *atomic.Int64    // JSON-RPC messages logged across all streams
+	pending    *pendingRequests // JSON-RPC requests awaiting a response
+	rpcSummary io.Writer        // if set, receives a one-line index entry per JSON-RPC message
+	pid        int              // child pid recorded in each entry, if non-zero
+	session    string           // session id recorded in each entry, if set
+	label      string           // label recorded in each entry, if set
+	host       string           // hostname recorded in each entry, if set
+	syslog     *syslogSink      // also receives each entry, without its timestamp
+	encoding   string           // stdout/stderr encoding to decode for the log
+	muted      bool             // forward the stream without logging its data
+	match      *regexp.Regexp   // if set, only stdout/stderr lines matching it are logged
+	noMatch    *regexp.Regexp   // if set, stdout/stderr lines matching it are not logged
+	annotate   bool             // record each entry's length and CRC32
+	ndjson     bool             // pretty-print lines that are JSON messages
+	noTime     bool             // leave timestamps out of the log
+	clock      func() time.Time // the time entries are stamped with
+	labelWidth int              // pad non-empty labels to this width
+	ansi       *ansiStripper    // if set, strips escape sequences from the log
+	seq        *atomic.Int64    // if set, numbers entries across all streams
+	lastDir    *string          // if set, direction of the last entry, for turn markers
+	budget     *logBudget       // if set, caps the bytes logged across all streams
+	trigger    *triggerGate     // if set, holds back the log until an entry matches
+	noMarkers  bool             // leave "--- ... ---" markers out of the log
+}
+
+// logBudget caps the bytes written to the log across all streams. Once
+// used passes max a marker is logged, once, and nothing else after it.
+type logBudget struct {
+	max       int64
+	used      atomic.Int64
+	exhausted atomic.Bool
+}
+
+// nextSeq returns the sequence number of the next entry, or 0 if entries
+// are not numbered. It is taken with mu held, so numbers follow log order.
+func (l *streamLog) nextSeq() int64 {
+	if l.seq == nil {
+		return 0
+	}
+	return l.seq.Add(1)
+}
+
+// seqText returns the "N " that starts a numbered text entry, or ""
+func (l *streamLog) seqText() string {
+	if n := l.nextSeq(); n > 0 {
+		return strconv.FormatInt(n, 10) + " "
+	}
+	return ""
+}
+
+// nowStamp returns the current time formatted for a log entry, or "" if
+// timestamps are left out. Entries take it with mu held.
+func (l *streamLog) nowStamp() string {
+	if l.noTime {
+		return ""
+	}
+	now := l.clock()
+	if !l.local {
+		now = now.UTC()
+	}
+	return now.Format(l.timeFormat)
+}
+
+// ids returns the "host=H label=L pid=N session=ID " fields that follow
+// the timestamp of each text line, each only if recorded, or ""
+func (l *streamLog) ids() string {
+	var ids string
+	if l.host != "" {
+		ids = "host=" + l.host + " "
+	}
+	if l.label != "" {
+		ids += "label=" + l.label + " "
+	}
+	if l.pid != 0 || l.session != "" {
+		ids += fmt.Sprintf("pid=%d session=%s ", l.pid, l.session)
+	}
+	return ids
+}
+
+// jsonEntry is one record of the -format json log
+type jsonEntry struct {
+	Seq     int64  `json:"seq,omitempty"`
+	TS      string `json:"ts,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Label   string `json:"label,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+	Session string `json:"session,omitempty"`
+	Dir     string `json:"dir"`
+	Data    string `json:"data"`
+	Len     int    `json:"len,omitempty"`
+	CRC     string `json:"crc,omitempty"`
+}
+
+// entry logs one chunk of data read from the stream dir, timestamped now,
+// and syncs the log. Nothing is logged when the stream is muted. In text
+// format it is written as "<timestamp> <label><data>", with a newline added
+// if terminate is set and data lacks one; in json format it is a single
+// record. In binary mode the text entry is a hex dump and json data is
+// hex-encoded. Escape sequences are stripped first if ansi is set, except
+// in binary and JSON-RPC mode. With annotate set the entry also records the
+// length and CRC32 of the data logged. With base64 set data is logged
+// base64-encoded instead, in place of any hex dump, and every entry is a
+// single line. In csv format it is a timestamp,direction,bytes,data record,
+// with data encoded as for json.
+func (l *streamLog) entry(dir, label string, data []byte, terminate bool) error {
+	if l.muted {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ansi != nil && !l.binary && l.rpc == nil {
+		// Under the lock, as the stripper's state carries over between entries
+		data = l.ansi.strip(data)
+	}
+	for _, re := range l.redact {
+		data = re.ReplaceAllLiteral(data, []byte(redactedText))
+	}
+	if l.trigger != nil {
+		if err := l.trigger.check(data); err != nil {
+			return err
+		}
+	}
+	timestamp := l.nowStamp()
+	if err := l.turnLocked(timestamp, dir); err != nil {
+		return err
+	}
+	size := len(data)
+	var annotation jsonEntry
+	if l.annotate {
+		annotation.Len, annotation.CRC = len(data), fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+		label = l.padLabel(label) + fmt.Sprintf("[len=%d crc=%s] ", annotation.Len, annotation.CRC)
+	}
+	if l.base64 {
+		data, terminate = base64.StdEncoding.AppendEncode(nil, data), true
+	} else if l.binary {
+		offset := l.offset
+		l.offset += int64(len(data))
+		if l.format == "text" {
+			text := fmt.Sprintf("%s%d bytes\n%s", l.padLabel(label), len(data), hexDump(data, offset))
+			return l.writeEntryLocked(timestamp, text)
+		}
+		data = []byte(hex.EncodeToString(data))
+	}
+	if l.format == "json" {
+		record, err := json.Marshal(jsonEntry{Seq: l.nextSeq(), TS: timestamp, Host: l.host, Label: l.label, PID: l.pid, Session: l.session, Dir: dir, Data: string(data), Len: annotation.Len, CRC: annotation.CRC})
+		if err != nil {
+			return err
+		}
+		if l.syslog != nil {
+			l.syslog.send(string(record))
+		}
+		return l.writeLocked(string(record) + "\n")
+	}
+	text := l.padLabel(label) + string(data)
+	if terminate && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	if l.format == "csv" {
+		// Syslog gets the entry as text, as it does csv markers
+		if l.syslog != nil {
+			l.syslog.send(l.ids() + text)
+		}
+		return l.writeLocked(csvRecord(timestamp, dir, strconv.Itoa(size), string(data)))
+	}
+	return l.writeEntryLocked(timestamp, text)
+}
+
+// turnLocked logs a "--- turn: <from>-><to> ---" marker before an entry of
+// direction dir when the previous entry, on any stream, had another one.
+// It tracks the direction with mu held, so markers follow log order.
+func (l *streamLog) turnLocked(timestamp, dir string) error {
+	if l.lastDir == nil {
+		return nil
+	}
+	last := *l.lastDir
+	*l.lastDir = dir
+	if last == "" || last == dir {
+		return nil
+	}
+	return l.markerLocked(timestamp, "turn", "turn: "+last+"->"+dir)
+}
+
+// padLabel pads a non-empty label with spaces to labelWidth, so the data of
+// text entries lines up whatever the stream
+func (l *streamLog) padLabel(label string) string {
+	if label == "" || len(label) >= l.labelWidth {
+		return label
+	}
+	return label + strings.Repeat(" ", l.labelWidth-len(label))
+}
+
+// markNoNewline appends noNewlineText to a line that ended without a
+// newline. JSON, CSV and base64 entries record the data exactly and are
+// left alone.
+func (l *streamLog) markNoNewline(line []byte) []byte {
+	if l.format != "text" || l.base64 {
+		return line
+	}
+	return append(line, noNewlineText...)
+}
+
+// wanted reports whether a stdout/stderr line passes the match filters
+func (l *streamLog) wanted(line []byte) bool {
+	return (l.match == nil || l.match.Match(line)) && (l.noMatch == nil || !l.noMatch.Match(line))
+}
+
+// jsonMarker is a marker in the -format json log, such as
+// {"event":"stdin_closed","text":"STDIN stream closed to target"}
+type jsonMarker struct {
+	Seq     int64  `json:"seq,omitempty"`
+	TS      string `json:"ts,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Label   string `json:"label,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+	Session string `json:"session,omitempty"`
+	Event   string `json:"event"`
+	Text    string `json:"text"`
+}
+
+// marker logs a "--- ... ---" line, or a record of event in json and csv
+// format. Nothing is logged with markers turned off.
+func (l *streamLog) marker(event, text string) error {
+	if l.noMarkers {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.markerLocked(l.nowStamp(), event, text)
+}
+
+// markerLocked logs a marker with mu held
+func (l *streamLog) markerLocked(timestamp, event, text string) error {
+	if l.noMarkers {
+		return nil
+	}
+	return l.recordLocked(timestamp, event, text)
+}
+
+// recordLocked writes text as a "--- ... ---" line or, in json format, a
+// jsonMarker record or, in csv format, a "<timestamp>,marker,,<text>"
+// record, with mu held
+func (l *streamLog) recordLocked(timestamp, event, text string) error {
+	switch l.format {
+	case "json":
+		record, err := json.Marshal(jsonMarker{Seq: l.nextSeq(), TS: timestamp, Host: l.host, Label: l.label, PID: l.pid, Session: l.session, Event: event, Text: text})
+		if err != nil {
+			return err
+		}
+		if l.syslog != nil {
+			l.syslog.send(string(record))
+		}
+		return l.writeLocked(string(record) + "\n")
+	case "csv":
+		if l.syslog != nil {
+			l.syslog.send(l.ids() + "--- " + text + " ---\n")
+		}
+		return l.writeLocked(csvRecord(timestamp, "marker", "", text))
+	}
+	return l.writeEntryLocked(timestamp, "--- "+text+" ---\n")
+}
+
+// markerText returns a marker, timestamped and numbered now, without
+// logging it, or "" with markers turned off. Callers that write it later
+// than mu would have, as asyncLog does, may log it out of sequence.
+func (l *streamLog) markerText(event, text string) string {
+	if l.noMarkers {
+		return ""
+	}
+	timestamp := l.nowStamp()
+	switch l.format {
+	case "json":
+		record, _ := json.Marshal(jsonMarker{Seq: l.nextSeq(), TS: timestamp, Host: l.host, Label: l.label, PID: l.pid, Session: l.session, Event: event, Text: text})
+		return string(record) + "\n"
+	case "csv":
+		return csvRecord(timestamp, "marker", "", text)
+	}
+	return l.seqText() + stamped(timestamp, l.ids()+"--- "+text+" ---\n")
+}
+
+// write logs text as is, after its sequence number if entries are numbered.
+// In json and csv format it is logged as an "error" record instead. It is
+// logged even with markers turned off.
+func (l *streamLog) write(text string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.format != "text" {
+		return l.recordLocked(l.nowStamp(), "error", strings.TrimSuffix(text, "\n"))
+	}
+	return l.writeLocked(l.seqText() + text)
+}
+
+// writeEntryLocked writes a text line as "<seq> <timestamp> <ids><text>",
+// sending it to syslog too without the sequence number, with mu held
+func (l *streamLog) writeEntryLocked(timestamp, text string) error {
+	if l.syslog != nil {
+		l.syslog.send(l.ids() + text)
+	}
+	return l.writeLocked(l.seqText() + stamped(timestamp, l.ids()+text))
+}
+
+// csvColumns names the fields of csv format records
+var csvColumns = []string{"timestamp", "direction", "bytes", "data"}
+
+// csvRecord returns fields as one line of CSV, quoted per RFC 4180 where
+// they contain commas, quotes or newlines
+func csvRecord(fields ...string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(fields)
+	w.Flush() // writing to a strings.Builder cannot fail
+	return b.String()
+}
+
+// columns writes the csv format's header record
+func (l *streamLog) columns() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writeLocked(csvRecord(csvColumns...))
+}
+
+// stamped returns text after timestamp and a space, or alone if timestamp
+// is empty
+func stamped(timestamp, text string) string {
+	if timestamp == "" {
+		return text
+	}
+	return timestamp + " " + text
+}
+
+// writeLocked writes text and syncs the log, with mu held. Timestamps are
+// taken under the same lock, so entries reach the log in timestamp order
+// even when the streams are logged concurrently. Text past the budget, if
+// any, is dropped.
+func (l *streamLog) writeLocked(text string) error {
+	if l.budget != nil && l.budget.used.Add(int64(len(text))) > l.budget.max {
+		if l.budget.exhausted.Swap(true) {
+			return nil
+		}
+		text = l.markerText("log_budget_exhausted", "log budget exhausted, further output not logged")
+	}
+	if _, err := io.WriteString(l.w, text); err != nil {
+		return err
+	}
+	return syncWriter(l.w)
+}
+
+// syncer is a log writer that can flush what it was written to stable
+// storage, such as *os.File or *LogFile. Logs need only be an io.Writer, so
+// an in-memory buffer works as well; syncing is skipped for writers without
+// a Sync method.
+type syncer interface {
+	io.Writer
+	Sync() error
+}
+
+// syncWriter syncs w if it is a syncer, skipping the proxy's own stdout and
+// stderr which are not real log files
+func syncWriter(w io.Writer) error {
+	if w == io.Writer(os.Stdout) || w == io.Writer(os.Stderr) {
+		return nil
+	}
+	if s, ok := w.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
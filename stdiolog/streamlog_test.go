@@ -0,0 +1,72 @@
+package stdiolog
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSyslogGetsEveryEntry(t *testing.T) {
+	for _, format := range []string{"text", "json", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			logger, _ := testLogger(&Proxy{Format: format})
+			var sent closeBuffer
+			logger.syslog = &syslogSink{w: &sent}
+			if err := logger.entry("out", "out: ", []byte("hi\n"), false); err != nil {
+				t.Fatal(err)
+			}
+			if err := logger.marker("stdout_eof", "stdout closed (EOF)"); err != nil {
+				t.Fatal(err)
+			}
+			got := sent.String()
+			if !strings.Contains(got, "hi") || !strings.Contains(got, "stdout closed (EOF)") {
+				t.Errorf("syslog got %q, want the entry and the marker", got)
+			}
+		})
+	}
+}
+
+func TestSeqWithCSV(t *testing.T) {
+	p := &Proxy{Command: "true", Shell: "none", Format: "csv", Seq: true, Log: &strings.Builder{}}
+	if _, err := p.Run(t.Context()); err == nil || !strings.Contains(err.Error(), "csv") {
+		t.Errorf("Run = %v, want an error rejecting -seq with csv", err)
+	}
+}
+
+func TestMarkerTextSeq(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"text", "1 out: hi\n2 --- 3 log entries dropped ---\n"},
+		{"json", `{"seq":1,"dir":"out","data":"hi\n"}` + "\n" + `{"seq":2,"event":"log_entries_dropped","text":"3 log entries dropped"}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			logger, log := testLogger(&Proxy{Format: tt.format})
+			logger.seq = new(atomic.Int64)
+			if err := logger.entry("out", "out: ", []byte("hi\n"), false); err != nil {
+				t.Fatal(err)
+			}
+			log.WriteString(logger.markerText("log_entries_dropped", "3 log entries dropped"))
+			if log.String() != tt.want {
+				t.Errorf("log = %q, want %q", log.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBudgetMarkerSeq(t *testing.T) {
+	logger, log := testLogger(&Proxy{})
+	logger.seq = new(atomic.Int64)
+	logger.budget = &logBudget{max: 20}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if err := logger.entry("out", "out: ", []byte(line), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The entry past the budget took number 2 before it was dropped
+	if want := "1 out: first\n3 --- log budget exhausted, further output not logged ---\n"; log.String() != want {
+		t.Errorf("log = %q, want %q", log.String(), want)
+	}
+}
@@ -0,0 +1,42 @@
+package stdiolog
+
+import (
+	"io"
+	"log"
+	"strings"
+)
+
+// Syslog sends each log entry to the system log as its own message, at a
+// priority that tells the streams apart. Open it with DialSyslog.
+type Syslog struct {
+	in, out, err syslogSink
+}
+
+// Close disconnects from the system log
+func (s *Syslog) Close() error {
+	for _, sink := range []*syslogSink{&s.in, &s.out, &s.err} {
+		if sink.w != nil {
+			sink.w.Close()
+		}
+	}
+	return nil
+}
+
+// syslogSink is the connection for one stream. After a failed send it stops
+// sending, so an unreachable daemon never holds up logging.
+type syslogSink struct {
+	w      io.WriteCloser
+	failed bool
+}
+
+// send writes msg, without its trailing newline, as one message. It is
+// called with the stream logger's lock held.
+func (s *syslogSink) send(msg string) {
+	if s.w == nil || s.failed {
+		return
+	}
+	if _, err := io.WriteString(s.w, strings.TrimSuffix(msg, "\n")); err != nil {
+		log.Printf("Error writing to syslog, no longer sending to it: %v", err)
+		s.failed = true
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !windows && !plan9
+
+package stdiolog
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogFacilities maps facility names to their priorities
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// DialSyslog connects to the local syslog daemon. Entries are sent with the
+// given facility (user if empty) and tag, at priority info for stdin, notice
+// for stdout and warning for stderr.
+func DialSyslog(facility, tag string) (*Syslog, error) {
+	if facility == "" {
+		facility = "user"
+	}
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	s := &Syslog{}
+	for _, stream := range []struct {
+		w        *syslogSink
+		priority syslog.Priority
+	}{{&s.in, syslog.LOG_INFO}, {&s.out, syslog.LOG_NOTICE}, {&s.err, syslog.LOG_WARNING}} {
+		w, err := syslog.New(f|stream.priority, tag)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		stream.w.w = w
+	}
+	return s, nil
+}
@@ -0,0 +1,8 @@
+package stdiolog
+
+import "errors"
+
+// DialSyslog is not supported on Windows
+func DialSyslog(facility, tag string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
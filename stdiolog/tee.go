@@ -0,0 +1,159 @@
+package stdiolog
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// teeQueue is how many log writes a TCP tee holds while the collector is slow
+// or unreachable; further writes are dropped
+const teeQueue = 1024
+
+// teeRetry is the delay between attempts to reconnect a TCP tee
+const teeRetry = time.Second
+
+// OpenTee opens a secondary log destination: a file path, or tcp://host:port
+// for a collector that is connected in the background and reconnected when it
+// fails. A file is created with permissions perm. Writes to a TCP tee never
+// block; they are dropped when it falls behind.
+func OpenTee(dest string, perm os.FileMode) (io.WriteCloser, error) {
+	if addr, ok := strings.CutPrefix(dest, "tcp://"); ok {
+		t := &tcpTee{addr: addr, queue: make(chan []byte, teeQueue), done: make(chan struct{}), finished: make(chan struct{})}
+		go t.run()
+		return t, nil
+	}
+	return os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm)
+}
+
+// teeLog writes to the primary log and its tees. Only the primary's errors
+// are reported and only the primary is synced, so failing tees never affect
+// the main log.
+type teeLog struct {
+	io.Writer // io.MultiWriter of primary and tees
+	primary   io.Writer
+}
+
+func newTeeLog(primary io.Writer, tees []io.Writer) *teeLog {
+	writers := []io.Writer{primary}
+	for _, tee := range tees {
+		writers = append(writers, &tolerantWriter{w: tee})
+	}
+	return &teeLog{Writer: io.MultiWriter(writers...), primary: primary}
+}
+
+func (t *teeLog) Write(p []byte) (int, error) {
+	if _, err := t.Writer.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *teeLog) Sync() error {
+	return syncWriter(t.primary)
+}
+
+// tolerantWriter reports the first error of a tee and then ignores it, so an
+// io.MultiWriter carries on to the other destinations
+type tolerantWriter struct {
+	w      io.Writer
+	failed atomic.Bool
+}
+
+func (t *tolerantWriter) Write(p []byte) (int, error) {
+	if _, err := t.w.Write(p); err != nil && !t.failed.Swap(true) {
+		log.Printf("Error writing to tee: %v", err)
+	}
+	return len(p), nil
+}
+
+// tcpTee sends log writes to a TCP collector from a background goroutine
+type tcpTee struct {
+	addr     string
+	queue    chan []byte
+	done     chan struct{}
+	finished chan struct{}
+	closed   sync.Once
+	dropped  atomic.Int64
+}
+
+func (t *tcpTee) Write(p []byte) (int, error) {
+	select {
+	case t.queue <- append([]byte(nil), p...):
+	default:
+		if t.dropped.Add(int64(len(p))) == int64(len(p)) {
+			log.Printf("Tee %s is falling behind, dropping log data", t.addr)
+		}
+	}
+	return len(p), nil
+}
+
+// run connects to the collector and sends queued writes until Close,
+// reconnecting whenever the connection fails
+func (t *tcpTee) run() {
+	defer close(t.finished)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	connected := true // report only the first failure of each outage
+	for {
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout("tcp", t.addr, teeRetry)
+			if err != nil {
+				if connected {
+					log.Printf("Error connecting to tee %s: %v", t.addr, err)
+					connected = false
+				}
+				select {
+				case <-time.After(teeRetry):
+					continue
+				case <-t.done:
+					return
+				}
+			}
+			connected = true
+		}
+		select {
+		case data := <-t.queue:
+			if _, err := conn.Write(data); err != nil {
+				log.Printf("Error writing to tee %s, reconnecting: %v", t.addr, err)
+				conn.Close()
+				conn = nil
+				connected = false
+			}
+		case <-t.done:
+			// Send what is already queued before closing, without letting a
+			// stalled collector hold up the exit
+			conn.SetWriteDeadline(time.Now().Add(teeRetry))
+			for {
+				select {
+				case data := <-t.queue:
+					if _, err := conn.Write(data); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops the tee after sending the writes already queued
+func (t *tcpTee) Close() error {
+	t.closed.Do(func() { close(t.done) })
+	<-t.finished
+	if dropped := t.dropped.Load(); dropped > 0 {
+		log.Printf("Tee %s dropped %d bytes of log data", t.addr, dropped)
+	}
+	return nil
+}
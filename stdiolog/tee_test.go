@@ -0,0 +1,28 @@
+package stdiolog
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestOpenTeeMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions on Windows")
+	}
+	// 0600 survives any usual umask
+	path := filepath.Join(t.TempDir(), "tee.log")
+	tee, err := OpenTee(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("mode = %o, want 600", mode)
+	}
+}
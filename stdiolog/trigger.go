@@ -0,0 +1,86 @@
+package stdiolog
+
+import (
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// triggerGate holds back the logs, per Proxy.Trigger, until an entry
+// matches re. Until then each log keeps its most recent entries in a ring,
+// if any, which is written out when the gate opens.
+type triggerGate struct {
+	re     *regexp.Regexp
+	mu     sync.Mutex // held while opening, so no entry slips between ring and log
+	fired  atomic.Bool
+	logs   []*triggerLog
+	marker func(event, text string) string // formats the trigger marker
+}
+
+// triggerLog is one log writer behind a triggerGate
+type triggerLog struct {
+	gate    *triggerGate
+	w       io.Writer
+	context *ringLog // entries logged before the trigger, or nil to drop them
+}
+
+// wrap puts w behind the gate, keeping up to context bytes of its entries
+// from before the trigger
+func (g *triggerGate) wrap(w io.Writer, context int) *triggerLog {
+	t := &triggerLog{gate: g, w: w}
+	if context > 0 {
+		t.context = newRingLog(w, context)
+		t.context.marker = func(event, text string) string { return g.marker(event, text) }
+	}
+	g.logs = append(g.logs, t)
+	return t
+}
+
+// check opens the gate if data, about to be logged, matches
+func (g *triggerGate) check(data []byte) error {
+	if g.fired.Load() || !g.re.Match(data) {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.fired.Load() {
+		return nil
+	}
+	g.fired.Store(true)
+	for _, t := range g.logs {
+		if t.context != nil {
+			if err := t.context.dump(); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(t.w, g.marker("trigger", "trigger matched, logging started")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write passes the entry on once the gate is open, and otherwise keeps it
+// in the context ring or drops it
+func (t *triggerLog) Write(p []byte) (int, error) {
+	if !t.gate.fired.Load() {
+		t.gate.mu.Lock()
+		if !t.gate.fired.Load() {
+			defer t.gate.mu.Unlock()
+			if t.context != nil {
+				return t.context.Write(p)
+			}
+			return len(p), nil
+		}
+		t.gate.mu.Unlock()
+	}
+	return t.w.Write(p)
+}
+
+func (t *triggerLog) Sync() error {
+	if !t.gate.fired.Load() {
+		return nil
+	}
+	return syncWriter(t.w)
+}
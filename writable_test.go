@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPermitsWrite(t *testing.T) {
+	dir := t.TempDir()
+	if !permitsWrite(dir) {
+		t.Errorf("permitsWrite(%s) = false for a new temp dir", dir)
+	}
+	if permitsWrite(filepath.Join(dir, "missing")) {
+		t.Error("permitsWrite = true for a missing dir")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("permitsWrite left %d files behind", len(entries))
+	}
+}
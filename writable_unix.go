@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// wOK is access(2)'s W_OK
+const wOK = 0x2
+
+// permitsWrite reports whether the permissions of dir let this process
+// create files in it, without writing anything
+func permitsWrite(dir string) bool {
+	return syscall.Access(dir, wOK) == nil
+}
@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// permitsWrite reports whether dir is a directory without the read-only
+// attribute, without writing anything
+func permitsWrite(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir() && info.Mode().Perm()&0200 != 0
+}